@@ -0,0 +1,317 @@
+package dryred
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The forwarding rules of clients.toml. Without any rule every front client can forward to every
+// back client, to any target. With rules, the first one matching decides, and no match denies:
+//
+//	[groups]
+//	admins = ["elisescu"]
+//	devices = ["pi", "raspberrypi_2"]
+//
+//	[[rule]]
+//	action = "deny"
+//	from = ["@interns"]
+//	to = ["*"]
+//	targets = ["*:22"]
+//
+//	[[rule]]
+//	action = "allow"
+//	from = ["@admins"]
+//	to = ["@devices", "router"]
+//	# Optional. The targets are host:port patterns, or service names, e.g. "localhost:*" or "ssh".
+//	# The host:port patterns also match the services at those addresses.
+//	targets = ["localhost:22", "192.168.0.*:80"]
+//	# Optional, in the server local time. The hours can wrap around midnight, e.g. "22:00-06:00"
+//	days = ["mon", "tue", "wed", "thu", "fri"]
+//	hours = "08:00-18:00"
+
+type ruleToml struct {
+	Action  string
+	From    []string
+	To      []string
+	Targets []string
+	Days    []string
+	Hours   string
+}
+
+// ForwardTarget is what a forwarded session connects to on the back client: a service, or an
+// address. The Address of a service is the one advertised by the back client, if any.
+type ForwardTarget struct {
+	Service string
+	Address string
+}
+
+func (target ForwardTarget) String() string {
+	switch {
+	case target.Service == "":
+		return target.Address
+	case target.Address == "":
+		return target.Service
+	}
+	return fmt.Sprintf("%s (%s)", target.Service, target.Address)
+}
+
+// ForwardDecision is the answer of the clients database to a forwarding request, with the rule
+// that decided it
+type ForwardDecision struct {
+	Allowed bool
+	// Rule describes the matched rule, or the default when none matched
+	Rule string
+}
+
+// aclRule is a rule of clients.toml, with the groups replaced by their clients
+type aclRule struct {
+	text  string
+	allow bool
+	// The client names, or nil for any
+	from map[string]bool
+	to   map[string]bool
+	// The target patterns, or nil for any
+	targets []string
+	// The days of the week, or nil for any
+	days map[time.Weekday]bool
+	// The time window, in minutes since midnight, unless both are zero
+	startMinute int
+	endMinute   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseACLRule checks the rule against the clients and groups, and expands the groups
+func parseACLRule(index int, rule ruleToml, groups map[string][]string, known func(string) bool) (*aclRule, error) {
+	parsed := &aclRule{
+		text: fmt.Sprintf("rule %d: %s from %s to %s", index, rule.Action,
+			strings.Join(rule.From, ","), strings.Join(rule.To, ",")),
+	}
+
+	switch rule.Action {
+	case "allow":
+		parsed.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("Rule %d: unknown action %q", index, rule.Action)
+	}
+
+	var err error
+	if parsed.from, err = expandACLNames(rule.From, groups, known); err != nil {
+		return nil, fmt.Errorf("Rule %d: %s", index, err.Error())
+	}
+	if parsed.to, err = expandACLNames(rule.To, groups, known); err != nil {
+		return nil, fmt.Errorf("Rule %d: %s", index, err.Error())
+	}
+
+	for _, target := range rule.Targets {
+		if _, err := path.Match(target, ""); err != nil {
+			return nil, fmt.Errorf("Rule %d: bad target pattern %q", index, target)
+		}
+		parsed.targets = append(parsed.targets, normalizeACLPattern(target))
+	}
+	if len(rule.Targets) > 0 {
+		parsed.text += " targets " + strings.Join(rule.Targets, ",")
+	}
+
+	if len(rule.Days) > 0 {
+		parsed.days = make(map[time.Weekday]bool)
+		for _, day := range rule.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("Rule %d: unknown day %q", index, day)
+			}
+			parsed.days[weekday] = true
+		}
+		parsed.text += " days " + strings.Join(rule.Days, ",")
+	}
+
+	if rule.Hours != "" {
+		hours := strings.Split(rule.Hours, "-")
+		if len(hours) != 2 {
+			return nil, fmt.Errorf("Rule %d: bad hours %q, expected e.g. 08:00-18:00", index,
+				rule.Hours)
+		}
+		start, err := time.Parse("15:04", hours[0])
+		if err == nil {
+			var end time.Time
+			end, err = time.Parse("15:04", hours[1])
+			parsed.startMinute = start.Hour()*60 + start.Minute()
+			parsed.endMinute = end.Hour()*60 + end.Minute()
+			if parsed.startMinute == parsed.endMinute {
+				err = fmt.Errorf("empty time window")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: bad hours %q, expected e.g. 08:00-18:00: %s",
+				index, rule.Hours, err.Error())
+		}
+		parsed.text += " hours " + rule.Hours
+	}
+
+	return parsed, nil
+}
+
+// normalizeACLAddress returns the host:port address the way the back client dials it: the host
+// lowercase, or the canonical form of an IP, and the port as a number, so that e.g.
+// LOCALHOST:022 and localhost:ssh are both localhost:22
+func normalizeACLAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	number, err := parseACLPort(port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(normalizeACLHost(host), strconv.Itoa(number)), nil
+}
+
+func normalizeACLHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func parseACLPort(port string) (int, error) {
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		if number, err = net.LookupPort("tcp", port); err != nil {
+			return 0, err
+		}
+	}
+	if number < 0 || number > 65535 {
+		return 0, fmt.Errorf("port %s out of range", port)
+	}
+	return number, nil
+}
+
+// normalizeACLPattern normalizes the host:port patterns like the addresses they match, e.g.
+// *:022 to *:22. The brackets of the IPv6 hosts are escaped, so that they are not read as a
+// character class. The patterns of service names are left as they are.
+func normalizeACLPattern(pattern string) string {
+	if !isACLAddressPattern(pattern) {
+		return pattern
+	}
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		// e.g. a character class in the host, 10.0.0.[1-5]:22
+		return strings.ToLower(pattern)
+	}
+	if number, err := parseACLPort(port); err == nil {
+		port = strconv.Itoa(number)
+	}
+	normalized := net.JoinHostPort(normalizeACLHost(host), port)
+	if strings.Contains(host, ":") {
+		normalized = strings.NewReplacer("[", "\\[", "]", "\\]").Replace(normalized)
+	}
+	return normalized
+}
+
+func isACLAddressPattern(pattern string) bool {
+	return strings.Contains(pattern, ":")
+}
+
+// expandACLNames returns the set of client names, or nil for "*"
+func expandACLNames(names []string, groups map[string][]string, known func(string) bool) (map[string]bool, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no clients")
+	}
+
+	expanded := make(map[string]bool)
+	for _, name := range names {
+		if name == "*" {
+			return nil, nil
+		}
+
+		if strings.HasPrefix(name, "@") {
+			members, ok := groups[name[1:]]
+			if !ok {
+				return nil, fmt.Errorf("unknown group %s", name)
+			}
+			for _, member := range members {
+				expanded[member] = true
+			}
+			continue
+		}
+
+		if !known(name) {
+			return nil, fmt.Errorf("unknown client %s", name)
+		}
+		expanded[name] = true
+	}
+	return expanded, nil
+}
+
+func (rule *aclRule) matchesClients(from, to ClientInfo) bool {
+	return (rule.from == nil || rule.from[from.Name()]) && (rule.to == nil || rule.to[to.Name()])
+}
+
+// conditional tells if the rule applies only to some targets, or some of the time
+func (rule *aclRule) conditional() bool {
+	return rule.targets != nil || rule.days != nil || rule.startMinute != rule.endMinute
+}
+
+// matchesTarget tells if a target pattern matches the service, or its address. The target
+// address is normalized.
+func (rule *aclRule) matchesTarget(pattern string, target ForwardTarget) bool {
+	if isACLAddressPattern(pattern) && target.Address == "" {
+		// The back client didn't advertise the address of the service, so it could be any.
+		// Only the deny rules apply.
+		return !rule.allow
+	}
+
+	if target.Service != "" && !isACLAddressPattern(pattern) {
+		if ok, _ := path.Match(pattern, target.Service); ok {
+			return true
+		}
+	}
+	ok, _ := path.Match(pattern, target.Address)
+	return ok
+}
+
+func (rule *aclRule) matches(from, to ClientInfo, target ForwardTarget, at time.Time) bool {
+	if !rule.matchesClients(from, to) {
+		return false
+	}
+
+	if rule.targets != nil {
+		matched := false
+		for _, pattern := range rule.targets {
+			if rule.matchesTarget(pattern, target) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if rule.days != nil && !rule.days[at.Weekday()] {
+		return false
+	}
+
+	if rule.startMinute != rule.endMinute {
+		minute := at.Hour()*60 + at.Minute()
+		if rule.startMinute < rule.endMinute {
+			return minute >= rule.startMinute && minute < rule.endMinute
+		}
+		// The window wraps around midnight
+		return minute >= rule.startMinute || minute < rule.endMinute
+	}
+	return true
+}
@@ -0,0 +1,289 @@
+package dryred
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomPubKey(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Can't generate a key: %s", err.Error())
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("Can't convert the key: %s", err.Error())
+	}
+	return encodeSSHPubKey(key)
+}
+
+func aclTestClients(t *testing.T) string {
+	clients := ""
+	for _, name := range []string{"elisescu", "intern"} {
+		clients += fmt.Sprintf("[[from]]\nclient_name = \"%s\"\npublic_key = \"%s\"\n", name,
+			randomPubKey(t))
+	}
+	for _, name := range []string{"pi", "router"} {
+		clients += fmt.Sprintf("[[to]]\nclient_name = \"%s\"\npublic_key = \"%s\"\n", name,
+			randomPubKey(t))
+	}
+	return clients
+}
+
+func TestClientsDBCheckForward(t *testing.T) {
+	clientsDB, err := ClientsDBFromToml(writeClientsToml(t, aclTestClients(t)+`
+[groups]
+staff = ["elisescu"]
+interns = ["intern"]
+devices = ["pi", "router"]
+
+[[rule]]
+action = "deny"
+from = ["@interns"]
+to = ["*"]
+targets = ["*:22"]
+
+[[rule]]
+action = "allow"
+from = ["@staff"]
+to = ["@devices"]
+days = ["mon", "tue", "wed", "thu", "fri"]
+hours = "08:00-18:00"
+
+[[rule]]
+action = "allow"
+from = ["*"]
+to = ["router"]
+targets = ["localhost:80", "web"]
+`))
+	if err != nil {
+		t.Fatalf("Can't load the clients: %s", err.Error())
+	}
+
+	client := func(name string) ClientInfo {
+		return clientsDB.FindClientByName(name)
+	}
+	address := func(address string) ForwardTarget {
+		return ForwardTarget{Address: address}
+	}
+	service := func(name, address string) ForwardTarget {
+		return ForwardTarget{Service: name, Address: address}
+	}
+	monday := time.Date(2024, 6, 3, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		from, to string
+		target   ForwardTarget
+		at       time.Time
+		allowed  bool
+		rule     string
+	}{
+		{"intern", "pi", address("localhost:22"), monday, false, "rule 1"},
+		{"intern", "router", address("localhost:80"), monday, true, "rule 3"},
+		{"intern", "router", service("web", "localhost:8080"), monday, true, "rule 3"},
+		{"intern", "pi", address("localhost:80"), monday, false, "no rule matched"},
+		{"elisescu", "pi", address("localhost:22"), monday, true, "rule 2"},
+		{"elisescu", "pi", address("localhost:22"), monday.Add(10 * time.Hour), false,
+			"no rule matched"},
+		{"elisescu", "pi", address("localhost:22"), monday.AddDate(0, 0, 5), false,
+			"no rule matched"},
+		{"elisescu", "router", service("web", "localhost:8080"), monday.AddDate(0, 0, 5), true,
+			"rule 3"},
+		// The address rules cover the services at those addresses
+		{"intern", "pi", service("ssh", "localhost:22"), monday, false, "rule 1"},
+		{"intern", "router", service("admin", "LOCALHOST:80"), monday, true, "rule 3"},
+		// The service of an unknown address is denied by the address deny rules
+		{"intern", "pi", service("ssh", ""), monday, false, "rule 1"},
+		// The addresses are compared the way the back client dials them
+		{"intern", "pi", address("localhost:022"), monday, false, "rule 1"},
+		{"intern", "pi", address("LocalHost.:ssh"), monday, false, "rule 1"},
+		{"intern", "router", address("localhost:0080"), monday, true, "rule 3"},
+		{"intern", "router", address("localhost"), monday, false, "bad address"},
+		{"intern", "router", address("localhost:99999"), monday, false, "bad address"},
+	}
+	for _, test := range tests {
+		decision := clientsDB.CheckForward(client(test.from), client(test.to), test.target,
+			test.at)
+		if decision.Allowed != test.allowed || !strings.HasPrefix(decision.Rule, test.rule) {
+			t.Fatalf("Unexpected decision for %s to %s, %s at %s: %+v", test.from, test.to,
+				test.target, test.at, decision)
+		}
+	}
+
+	if clientsDB.ForwardAllowedFromTo(client("intern"), client("pi")) ||
+		!clientsDB.ForwardAllowedFromTo(client("intern"), client("router")) ||
+		!clientsDB.ForwardAllowedFromTo(client("elisescu"), client("pi")) {
+		t.Fatalf("Unexpected back clients allowed")
+	}
+}
+
+func TestClientsDBCheckForwardIPv6(t *testing.T) {
+	clientsDB, err := ClientsDBFromToml(writeClientsToml(t, aclTestClients(t)+`
+[[rule]]
+action = "deny"
+from = ["*"]
+to = ["*"]
+targets = ["[::1]:22", "127.0.0.1:22", "[fe80::*]:*"]
+
+[[rule]]
+action = "allow"
+from = ["*"]
+to = ["*"]
+`))
+	if err != nil {
+		t.Fatalf("Can't load the clients: %s", err.Error())
+	}
+
+	from := clientsDB.FindClientByName("elisescu")
+	to := clientsDB.FindClientByName("pi")
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"[::1]:22", false},
+		{"[0:0::1]:022", false},
+		{"[::ffff:127.0.0.1]:22", false},
+		{"[FE80::1]:80", false},
+		{"[::1]:80", true},
+		{"[::2]:22", true},
+	}
+	for _, test := range tests {
+		decision := clientsDB.CheckForward(from, to, ForwardTarget{Address: test.address},
+			time.Now())
+		if decision.Allowed != test.allowed {
+			t.Fatalf("Unexpected decision for %s: %+v", test.address, decision)
+		}
+	}
+}
+
+func TestClientsDBRejectsBadRules(t *testing.T) {
+	tests := []struct {
+		rules    string
+		expected string
+	}{
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"@nobody\"]\nto = [\"*\"]\n",
+			"unknown group @nobody"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"nobody\"]\nto = [\"*\"]\n",
+			"unknown client nobody"},
+		{"[[rule]]\naction = \"maybe\"\nfrom = [\"*\"]\nto = [\"*\"]\n",
+			"unknown action"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"*\"]\nto = [\"*\"]\nhours = \"8 to 18\"\n",
+			"bad hours"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"*\"]\nto = [\"*\"]\nhours = \"08:00-18:00pm\"\n",
+			"bad hours"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"*\"]\nto = [\"*\"]\nhours = \"08:00-24:00\"\n",
+			"bad hours"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"*\"]\nto = [\"*\"]\nhours = \"-1:00-08:00\"\n",
+			"bad hours"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"*\"]\nto = [\"*\"]\nhours = \"08:60-18:00\"\n",
+			"bad hours"},
+		{"[[rule]]\naction = \"allow\"\nfrom = [\"*\"]\nto = [\"*\"]\nhours = \"08:00-08:00\"\n",
+			"empty time window"},
+		{"[groups]\nstaff = [\"nobody\"]\n", "Unknown client nobody in group staff"},
+	}
+	for _, test := range tests {
+		_, err := ClientsDBFromToml(writeClientsToml(t, aclTestClients(t)+test.rules))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Expected %q, got: %v", test.expected, err)
+		}
+	}
+}
+
+func TestDRServerForwardingRules(t *testing.T) {
+	const serverAddress string = "localhost:7036"
+	const allowedAddress string = "localhost:7037"
+	const deniedAddress string = "localhost:7038"
+
+	defer startEchoServer(t, allowedAddress).Close()
+	defer startEchoServer(t, deniedAddress).Close()
+
+	clientsDB, err := ClientsDBFromToml(writeClientsToml(t, fmt.Sprintf(`
+[[from]]
+client_name = "elisescu"
+public_key = "%s"
+[[to]]
+client_name = "pi"
+public_key = "%s"
+
+[[rule]]
+action = "deny"
+from = ["elisescu"]
+to = ["pi"]
+targets = ["%s"]
+
+[[rule]]
+action = "allow"
+from = ["elisescu"]
+to = ["pi"]
+`, readPubKey(t, "testdata/front_id_rsa.pub"), readPubKey(t, "testdata/back_id_rsa.pub"),
+		deniedAddress)))
+	if err != nil {
+		t.Fatalf("Can't load the clients: %s", err.Error())
+	}
+	server, err := DRServerSSHNew(DRServerSSHConfig{
+		SSHServerKeyPassphrase: "TestTest",
+		SSHServerKeyFileName:   "testdata/server_id_rsa",
+		ClientsDB:              clientsDB,
+	})
+	if err != nil {
+		t.Fatal("Can't create server: ", err)
+	}
+	go server.ListenAndServe(serverAddress)
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// The back client would serve any address, but the server rules don't allow it
+	backClient, err := DRClientSSHNew(DRClientSSHConfig{
+		SSHKeyFileName:   "testdata/back_id_rsa",
+		SSHKeyPassPhrase: "TestTest",
+		User:             "pi",
+		KnownHostsFile:   filepath.Join(t.TempDir(), "known_hosts"),
+		Services: map[string]string{
+			"echo": allowedAddress,
+			"ssh":  deniedAddress,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Can't create back client: %s", err.Error())
+	}
+	go backClient.ServeViaServer(serverAddress, func(session FWSession) {
+		targetConn, err := net.Dial("tcp", session.Request().BackConnectionAddress)
+		if err != nil {
+			session.Reject(err.Error())
+			return
+		}
+		frontConn, err := session.Accept()
+		if err != nil {
+			targetConn.Close()
+			return
+		}
+		forwardConnections(frontConn, targetConn)
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	for _, target := range []string{allowedAddress, "echo"} {
+		frontConn, err := frontClient.Connect(serverAddress, "pi", target)
+		if err != nil {
+			t.Fatalf("Can't connect to the allowed target %s: %s", target, err.Error())
+		}
+		checkEcho(t, frontConn)
+		frontConn.Close()
+	}
+
+	// Neither the service at the denied address, nor another spelling of the address, get
+	// past the rules
+	for _, target := range []string{deniedAddress, "ssh", "LOCALHOST:07038"} {
+		_, err = frontClient.Connect(serverAddress, "pi", target)
+		if !errors.Is(err, ErrForbiddenTarget) {
+			t.Fatalf("Expected the target %s to be denied, got: %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/elisescu/dryred/drconfig"
+	"os"
+	"strings"
+)
+
+// loadConfig reads the dr_config file. A missing file is an empty config.
+func loadConfig() (*drconfig.Config, error) {
+	config, err := drconfig.Load(*configFile)
+	if os.IsNotExist(err) {
+		return &drconfig.Config{}, nil
+	}
+	return config, err
+}
+
+// findForwarder returns the forwarder of the "device.service" name
+func findForwarder(config *drconfig.Config, name string) (*drconfig.Forwarder, error) {
+	_, service := config.Lookup(name)
+	if service == nil || service.Forwarder == nil {
+		return nil, fmt.Errorf("No forwarder named %s", name)
+	}
+	return service.Forwarder, nil
+}
+
+// forwardTarget returns what the "device.service" name connects to on the device: the remote
+// address of its forwarder, or else the service name, resolved by the device
+func forwardTarget(config *drconfig.Config, name string) (string, error) {
+	if fw, err := findForwarder(config, name); err == nil {
+		return fw.RemoteAddress, nil
+	}
+
+	_, service, err := drconfig.SplitName(name)
+	if err != nil || service == "" {
+		return "", fmt.Errorf("No forwarder named %s, and it's not of the form device.service",
+			name)
+	}
+	return service, nil
+}
+
+// forwarderNames returns the "device.service" names of all the forwarders
+func forwarderNames(config *drconfig.Config) []string {
+	var names []string
+	for _, host := range config.Hosts {
+		for _, service := range host.Services {
+			if service.Forwarder != nil {
+				names = append(names, host.Name+"."+service.Name)
+			}
+		}
+	}
+	return names
+}
+
+// routeDevice returns the back client name of a "device.service" name
+func routeDevice(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
+
+func contains(names []string, name string) bool {
+	for _, other := range names {
+		if other == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRoute splits a device.service=value argument
+func splitRoute(arg string) (string, string, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Expected name=value, got %q", arg)
+	}
+
+	if _, service, err := drconfig.SplitName(parts[0]); err != nil || service == "" {
+		return "", "", fmt.Errorf("Name %q is not of the form device.service", parts[0])
+	}
+	return parts[0], parts[1], nil
+}
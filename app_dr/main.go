@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/elisescu/dryred"
+	"github.com/elisescu/dryred/drconfig"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+type command struct {
+	args    string
+	help    string
+	minArgs int
+	maxArgs int
+	run     func(args []string) error
+}
+
+// usageError is returned by the commands for the arguments they can't use, so that dr exits
+// with exitUsage
+type usageError struct {
+	error
+}
+
+var commands map[string]command
+var commandNames = []string{"list", "ssh", "ssh_config", "proxy", "start", "add-fw", "add-rv",
+	"serve", "trust"}
+
+var (
+	serverAddress = flag.String("server", os.Getenv("DR_SERVER"), "Server address, host:port")
+	keyFileName   = flag.String("key", filepath.Join(homeDir(), ".ssh", "id_rsa"),
+		"SSH private key file")
+	passphraseFile = flag.String("passphrase-file", "",
+		"File holding the key passphrase. DR_KEY_PASSPHRASE can be used instead")
+	userName = flag.String("user", os.Getenv("USER"), "Client name, as known by the server")
+	useAgent = flag.Bool("agent", os.Getenv("SSH_AUTH_SOCK") != "",
+		"Offer the ssh-agent keys, before the key file")
+	agentKey   = flag.String("agent-key", "", "Agent key fingerprint or comment. By default all")
+	configFile = flag.String("config", filepath.Join(homeDir(), ".dryred", "dr_config"),
+		"The dr_config file")
+	knownHostsFile = flag.String("known-hosts", dryred.DefaultKnownHostsFile(),
+		"File holding the trusted server keys")
+	hostKeyPolicy = flag.String("host-key-policy", "tofu",
+		"Server key verification: tofu, strict or pinned")
+	serverFingerprint = flag.String("server-fingerprint", "",
+		"The only server key fingerprint accepted by the pinned policy")
+	keepAliveInterval = flag.Duration("keepalive", 30*time.Second,
+		"How often serve checks the connection to the server. 0 disables it")
+	endToEnd = flag.Bool("e2e", true,
+		"Encrypts the sessions end-to-end, so the server only forwards ciphertext")
+	requireEndToEnd = flag.Bool("require-e2e", false,
+		"Makes serve refuse the sessions that are not end-to-end, e.g. of a plain ssh -J via "+
+			"the server")
+	peersFile = flag.String("peers", filepath.Join(homeDir(), ".dryred", "peers.toml"),
+		"The keys of the users and devices at the other end of the end-to-end sessions, in "+
+			"the clients.toml format")
+)
+
+func init() {
+	commands = map[string]command{
+		"list": {
+			args:    "[--json]",
+			help:    "Lists the devices reachable via the server, with their status and services",
+			maxArgs: 1,
+			run:     cmdList,
+		},
+		"ssh": {
+			args:    "<name> [ssh arguments]",
+			help:    "Connects with ssh via the <name> forwarder",
+			minArgs: 1,
+			maxArgs: -1,
+			run:     cmdSSH,
+		},
+		"ssh_config": {
+			args:    "<device|device.service|--all>",
+			help:    "Prints ssh config Host blocks, using dr proxy, for the services of <name>",
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdSSHConfig,
+		},
+		"proxy": {
+			args:    "<device.service>",
+			help:    "Connects to the service and pipes stdin/stdout. Used as ssh ProxyCommand",
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdProxy,
+		},
+		"start": {
+			args:    "<name|--all>",
+			help:    "Starts the <name> forwarder, or all of them",
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdStart,
+		},
+		"add-fw": {
+			args:    "<name=localport:remote_host:remote_port>",
+			help:    "Adds a forwarder to a device service, e.g. po.ssh=8000:localhost:22",
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdAddFW,
+		},
+		"add-rv": {
+			args:    "<name=host:hostport>",
+			help:    "Adds a destination served by this device, e.g. po.router=192.168.0.1:80",
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdAddRV,
+		},
+		"serve": {
+			help: "Runs as back client, forwarding the sessions to this device destinations",
+			run:  cmdServe,
+		},
+		"trust": {
+			args:    "<server>",
+			help:    "Shows the server key fingerprint and adds it to the known hosts, if accepted",
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdTrust,
+		},
+	}
+}
+
+func homeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return home
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: dr [flags] <command> [arguments]\n\nCommands:\n")
+	for _, name := range commandNames {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, cmd.args)
+		fmt.Fprintf(os.Stderr, "               %s\n", cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		usage()
+		if flag.NArg() == 0 {
+			os.Exit(exitUsage)
+		}
+		os.Exit(exitOK)
+	}
+
+	name := flag.Arg(0)
+	args := flag.Args()[1:]
+	cmd, ok := commands[name]
+
+	if !ok {
+		fmt.Fprintf(os.Stderr, "dr: unknown command %q\n\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		fmt.Fprintf(os.Stderr, "Usage: dr %s %s\n  %s\n", name, cmd.args, cmd.help)
+		os.Exit(exitUsage)
+	}
+
+	if err := cmd.run(args); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "dr %s: %s\n", name, err.Error())
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(os.Stderr, "Usage: dr %s %s\n  %s\n", name, cmd.args, cmd.help)
+			os.Exit(exitUsage)
+		}
+		os.Exit(exitError)
+	}
+	os.Exit(exitOK)
+}
+
+// newClient creates the client with the flags settings. The key passphrase is asked only when
+// interactive, since stdin can be used for data, e.g. in proxy mode. The clients for sessions
+// load the peers, unless end-to-end is disabled.
+func newClient(interactive, sessions bool) (dryred.DRClient, error) {
+	config, err := clientConfig(interactive, sessions)
+	if err != nil {
+		return nil, err
+	}
+	return dryred.DRClientSSHNew(config)
+}
+
+// clientConfig returns the client configuration of the flags settings
+func clientConfig(interactive, sessions bool) (dryred.DRClientSSHConfig, error) {
+	if *serverAddress == "" {
+		return dryred.DRClientSSHConfig{}, fmt.Errorf("No server address. Use -server or DR_SERVER")
+	}
+
+	policy, err := dryred.ParseHostKeyPolicy(*hostKeyPolicy)
+	if err != nil {
+		return dryred.DRClientSSHConfig{}, err
+	}
+
+	var peersDB dryred.ClientsDB
+	if sessions && *endToEnd {
+		peersDB, err = dryred.ClientsDBFromToml(*peersFile)
+		if err != nil {
+			return dryred.DRClientSSHConfig{}, fmt.Errorf("Cannot load the end-to-end peers "+
+				"from %s: %s. Add the peers keys there, or use -e2e=false to let the server "+
+				"see the data", *peersFile, err.Error())
+		}
+	}
+
+	return dryred.DRClientSSHConfig{
+		SSHKeyFileName:       *keyFileName,
+		SSHKeyPassPhraseEnv:  "DR_KEY_PASSPHRASE",
+		SSHKeyPassPhraseFile: *passphraseFile,
+		AskPassPhrase:        interactive,
+		User:                 *userName,
+		UseAgent:             *useAgent,
+		AgentKey:             *agentKey,
+		HostKeyPolicy:        policy,
+		KnownHostsFile:       *knownHostsFile,
+		ServerKeyFingerprint: *serverFingerprint,
+		KeepAliveInterval:    *keepAliveInterval,
+		PeersDB:              peersDB,
+	}, nil
+}
+
+// waitForSignal blocks until the user interrupts the program
+func waitForSignal() {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	<-signalChannel
+	log.Printf("Caught signal. Stopping..")
+}
+
+// route is a device reachable via the server, as printed by dr list
+type route struct {
+	Name           string     `json:"name"`
+	Online         bool       `json:"online"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	RemoteAddress  string     `json:"remote_address,omitempty"`
+	Services       []string   `json:"services"`
+}
+
+func cmdList(args []string) error {
+	jsonOutput := len(args) == 1 && args[0] == "--json"
+	if len(args) == 1 && !jsonOutput {
+		return usageError{fmt.Errorf("Unknown argument %s", args[0])}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(true, false)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	backClients, err := client.ListBackClients(ctx, *serverAddress)
+	if err != nil {
+		return err
+	}
+
+	routes := []route{}
+	for _, backClient := range backClients {
+		// The services advertised by the device, and the ones configured locally for it
+		services := append([]string{}, backClient.Services...)
+		if host := config.Host(backClient.Name); host != nil {
+			for _, service := range host.Services {
+				if service.Forwarder != nil && !contains(services, service.Name) {
+					services = append(services, service.Name)
+				}
+			}
+		}
+		route := route{
+			Name:          backClient.Name,
+			Online:        backClient.Online,
+			RemoteAddress: backClient.RemoteAddress,
+			Services:      services,
+		}
+		if backClient.Online {
+			since := backClient.ConnectedSince
+			route.ConnectedSince = &since
+		}
+		routes = append(routes, route)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(routes)
+	}
+
+	fmt.Printf("%-20s %-8s %-20s %-22s %s\n", "NAME", "STATUS", "SINCE", "ADDRESS", "SERVICES")
+	for _, route := range routes {
+		status, since, address := "offline", "-", "-"
+		if route.Online {
+			status = "online"
+			since = route.ConnectedSince.Local().Format("2006-01-02 15:04:05")
+			address = route.RemoteAddress
+		}
+		services := strings.Join(route.Services, ",")
+		if services == "" {
+			services = "-"
+		}
+		fmt.Printf("%-20s %-8s %-20s %-22s %s\n", route.Name, status, since, address, services)
+	}
+	return nil
+}
+
+func cmdSSH(args []string) error {
+	name := args[0]
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	target, err := forwardTarget(config, name)
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(true, true)
+	if err != nil {
+		return err
+	}
+
+	// Forward a random local port for the lifetime of the ssh process
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return fmt.Errorf("Cannot listen on a local port: %s", err.Error())
+	}
+
+	forwarder := dryred.DRForwarderNew(dryred.DRForwarderConfig{
+		Client:                client,
+		ServerAddress:         *serverAddress,
+		BackClientName:        routeDevice(name),
+		BackConnectionAddress: target,
+	})
+	go forwarder.Serve(listener)
+	defer forwarder.Stop()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	sshArgs := append([]string{"-p", strconv.Itoa(port), "-o", "HostKeyAlias=" + name,
+		"localhost"}, args[1:]...)
+
+	sshCmd := exec.Command("ssh", sshArgs...)
+	sshCmd.Stdin = os.Stdin
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+	return sshCmd.Run()
+}
+
+func cmdSSHConfig(args []string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	drPath, err := os.Executable()
+	if err != nil {
+		drPath = "dr"
+	}
+	// Pass the current settings, so the proxy works regardless of the ssh environment
+	proxyCommand := shellQuote(drPath)
+	for _, setting := range []struct{ flag, value string }{
+		{"server", *serverAddress},
+		{"config", *configFile},
+		{"key", *keyFileName},
+		{"passphrase-file", *passphraseFile},
+		{"user", *userName},
+		{"agent", strconv.FormatBool(*useAgent)},
+		{"agent-key", *agentKey},
+		{"known-hosts", *knownHostsFile},
+		{"host-key-policy", *hostKeyPolicy},
+		{"server-fingerprint", *serverFingerprint},
+		{"e2e", strconv.FormatBool(*endToEnd)},
+		{"peers", *peersFile},
+	} {
+		if setting.value != "" {
+			proxyCommand += " " + shellQuote("-"+setting.flag+"="+setting.value)
+		}
+	}
+	proxyCommand += " proxy"
+
+	var names []string
+	for _, name := range forwarderNames(config) {
+		if args[0] == "--all" || args[0] == name || args[0] == routeDevice(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("No forwarders matching %s", args[0])
+	}
+
+	for _, name := range names {
+		fmt.Printf("Host %s\n", name)
+		fmt.Printf("    HostKeyAlias %s\n", name)
+		fmt.Printf("    ProxyCommand %s %s\n\n", proxyCommand, shellQuote(name))
+	}
+	return nil
+}
+
+// shellQuote quotes the argument for /bin/sh, which runs the ssh ProxyCommand, and escapes the %
+// of the ssh tokens
+func shellQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func cmdProxy(args []string) error {
+	name := args[0]
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	target, err := forwardTarget(config, name)
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(false, true)
+	if err != nil {
+		return err
+	}
+
+	conn, err := client.Connect(*serverAddress, routeDevice(name), target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+			halfCloser.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+func cmdStart(args []string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	names := []string{args[0]}
+	if args[0] == "--all" {
+		names = forwarderNames(config)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("No forwarders. Add one with add-fw")
+	}
+
+	client, err := newClient(true, true)
+	if err != nil {
+		return err
+	}
+
+	var forwarders []dryred.DRForwarder
+	failures := make(chan error, len(names))
+
+	for _, name := range names {
+		fw, err := findForwarder(config, name)
+		if err != nil {
+			return err
+		}
+
+		forwarder := dryred.DRForwarderNew(dryred.DRForwarderConfig{
+			Client:                client,
+			ServerAddress:         *serverAddress,
+			BackClientName:        routeDevice(name),
+			BackConnectionAddress: fw.RemoteAddress,
+		})
+		forwarders = append(forwarders, forwarder)
+
+		address := fmt.Sprintf("localhost:%d", fw.LocalPort)
+		go func(name string) {
+			if err := forwarder.ListenAndServe(address); err != nil {
+				failures <- fmt.Errorf("Forwarder %s stopped: %s", name, err.Error())
+			}
+		}(name)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		waitForSignal()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		err = nil
+	case err = <-failures:
+	}
+
+	for _, forwarder := range forwarders {
+		forwarder.Stop()
+	}
+	return err
+}
+
+func cmdAddFW(args []string) error {
+	name, value, err := splitRoute(args[0])
+	if err != nil {
+		return err
+	}
+
+	forwarder, err := drconfig.ParseForwarder("tcp:" + strings.TrimPrefix(value, "tcp:"))
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	hostName, serviceName, _ := drconfig.SplitName(name)
+	config.AddHost(hostName).AddService(serviceName).Forwarder = forwarder
+	return config.Save(*configFile)
+}
+
+func cmdAddRV(args []string) error {
+	name, value, err := splitRoute(args[0])
+	if err != nil {
+		return err
+	}
+
+	address, err := drconfig.ParseAddress("tcp:" + strings.TrimPrefix(value, "tcp:"))
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	hostName, serviceName, _ := drconfig.SplitName(name)
+	config.AddHost(hostName).AddService(serviceName).DestinationAddress = address
+	return config.Save(*configFile)
+}
+
+func cmdServe(args []string) error {
+	if *requireEndToEnd && !*endToEnd {
+		return usageError{fmt.Errorf("-require-e2e needs -e2e")}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Serve the destinations of the device section named as this client, and advertise them
+	var allowed []string
+	services := make(map[string]string)
+	if host := config.Host(*userName); host != nil {
+		for _, service := range host.Services {
+			if service.DestinationAddress != nil {
+				allowed = append(allowed, service.DestinationAddress.Address)
+				services[service.Name] = service.DestinationAddress.Address
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return fmt.Errorf("No destinations for %s. Add one with add-rv", *userName)
+	}
+
+	drClientConfig, err := clientConfig(true, true)
+	if err != nil {
+		return err
+	}
+	drClientConfig.Services = services
+	drClientConfig.RequireEndToEnd = *requireEndToEnd
+
+	client, err := dryred.DRClientSSHNew(drClientConfig)
+	if err != nil {
+		return err
+	}
+
+	supervisor := dryred.DRSupervisorNew(dryred.DRSupervisorConfig{
+		Client:        client,
+		ServerAddress: *serverAddress,
+		Handler:       dryred.FWDialHandlerNew(allowed),
+		StateChanged: func(state dryred.BackClientState, err error) {
+			if err != nil {
+				log.Printf("%s %s: %s", state, *serverAddress, err.Error())
+				return
+			}
+			log.Printf("%s %s", state, *serverAddress)
+		},
+	})
+	go func() {
+		waitForSignal()
+		supervisor.Stop()
+	}()
+
+	return supervisor.Run()
+}
+
+func cmdTrust(args []string) error {
+	address := args[0]
+	key, err := dryred.FetchServerKey(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Server %s has %s key %s\n", address, key.Type(), ssh.FingerprintSHA256(key))
+
+	err = dryred.CheckServerKey(*knownHostsFile, address, key)
+	if err == nil {
+		fmt.Printf("The key is already trusted\n")
+		return nil
+	}
+
+	var hostKeyErr *dryred.HostKeyError
+	if !errors.As(err, &hostKeyErr) {
+		return err
+	}
+	if len(hostKeyErr.Known) > 0 {
+		return fmt.Errorf("%s\nRemove the old key from %s if the change is expected",
+			err.Error(), *knownHostsFile)
+	}
+
+	fmt.Printf("Trust this key? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		return fmt.Errorf("Key not trusted")
+	}
+
+	return dryred.TrustServerKey(*knownHostsFile, address, key)
+}
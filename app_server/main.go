@@ -1,41 +1,177 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/elisescu/dryred"
+	"log"
 	"os"
 	"os/signal"
-	"flag"
-	"log"
-	"sync"
-	"golang.org/x/crypto/ssh"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func install_signal(fn func ()) {
-	signal_channel := make (chan os.Signal, 1)
-	signal.Notify(signal_channel, os.Interrupt)
-	signal.Notify(signal_channel, os.Kill)
+func install_signal(fn func()) {
+	signal_channel := make(chan os.Signal, 1)
+	signal.Notify(signal_channel, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		<- signal_channel
+		<-signal_channel
 		fn()
 	}()
 }
 
+// watch_clients reloads the clients file on SIGHUP, and when it changes, checking it every interval.
+// A file that can't be loaded is logged, and the server keeps the clients it has.
+func watch_clients(server dryred.DRServer, clients_file string, interval time.Duration) {
+	reload := func() {
+		clientsDB, err := dryred.ClientsDBFromToml(clients_file)
+		if err != nil {
+			log.Printf("Cannot reload clients from %s: %s", clients_file, err.Error())
+			return
+		}
+		server.ReloadClientsDB(clientsDB)
+	}
+
+	file_version := func() string {
+		info, err := os.Stat(clients_file)
+		if err != nil {
+			return ""
+		}
+		return info.ModTime().String() + " " + strconv.FormatInt(info.Size(), 10)
+	}
+
+	hangup_channel := make(chan os.Signal, 1)
+	signal.Notify(hangup_channel, syscall.SIGHUP)
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticks = time.NewTicker(interval).C
+	}
+
+	go func() {
+		version := file_version()
+		for {
+			select {
+			case <-hangup_channel:
+				log.Printf("Caught SIGHUP. Reloading %s", clients_file)
+			case <-ticks:
+				new_version := file_version()
+				if new_version == version || new_version == "" {
+					continue
+				}
+				log.Printf("%s changed. Reloading it", clients_file)
+			}
+			version = file_version()
+			reload()
+		}
+	}()
+}
+
+// acl_test explains which rule of the clients file decides a forwarding request, and exits with 1
+// if it's denied: dr-server acl test <from> <to> <target> [time]. The target is a host:port
+// address, a service name, or a service with its address, e.g. ssh=localhost:22.
+func acl_test(clients_file string, args []string) {
+	if len(args) < 3 || len(args) > 4 {
+		log.Fatalf("Usage: dr-server [-clients file] acl test <from> <to> " +
+			"<host:port|service|service=host:port> [time, RFC 3339]")
+	}
+
+	clientsDB, err := dryred.ClientsDBFromToml(clients_file)
+	if err != nil {
+		log.Fatalf("Cannot load clients from %s: %s", clients_file, err.Error())
+	}
+
+	from := clientsDB.FindClientByName(args[0])
+	if from == nil {
+		log.Fatalf("Unknown client %s", args[0])
+	}
+	to := clientsDB.FindClientByName(args[1])
+	if to == nil {
+		log.Fatalf("Unknown client %s", args[1])
+	}
+
+	at := time.Now()
+	if len(args) == 4 {
+		at, err = time.Parse(time.RFC3339, args[3])
+		if err != nil {
+			log.Fatalf("Cannot parse the time %s: %s", args[3], err.Error())
+		}
+	}
+
+	var target dryred.ForwardTarget
+	if parts := strings.SplitN(args[2], "=", 2); len(parts) == 2 {
+		target = dryred.ForwardTarget{Service: parts[0], Address: parts[1]}
+	} else if strings.Contains(args[2], ":") {
+		target = dryred.ForwardTarget{Address: args[2]}
+	} else {
+		target = dryred.ForwardTarget{Service: args[2]}
+	}
+
+	decision := clientsDB.CheckForward(from, to, target, at)
+	if !decision.Allowed {
+		fmt.Printf("denied: %s\n", decision.Rule)
+		os.Exit(1)
+	}
+	fmt.Printf("allowed: %s\n", decision.Rule)
+}
+
 func main() {
-	var wg sync.WaitGroup
-	server_port := flag.Int("port", 1234, "Port to listen to")
-	server := dryred.DRServerNew(*server_port)
+	listen_address := flag.String("listen", ":9000", "Address to listen to")
+	clients_file := flag.String("clients", "clients.toml", "Clients database file")
+	key_files := flag.String("key", "server_id_rsa",
+		"SSH server private key files, comma separated, e.g. server_id_ed25519,server_id_rsa")
+	passphrase_file := flag.String("passphrase-file", "",
+		"File holding the keys passphrase. DR_SERVER_KEY_PASSPHRASE can be used instead")
+	handshake_timeout := flag.Duration("handshake-timeout", 10*time.Second,
+		"Time given to the clients to authenticate and register")
+	keepalive := flag.Duration("keepalive", 30*time.Second,
+		"How often the clients are checked. Negative disables it")
+	idle_timeout := flag.Duration("idle-timeout", 0,
+		"Disconnects the clients silent for so long. 0 disables it")
+	reload_interval := flag.Duration("reload-interval", 10*time.Second,
+		"How often the clients file is checked for changes. 0 disables it, leaving only SIGHUP")
+	drop_revoked := flag.Bool("drop-revoked", true,
+		"Disconnects the clients removed from the clients file, or with a new key")
+	flag.Parse()
+
+	if flag.NArg() >= 2 && flag.Arg(0) == "acl" && flag.Arg(1) == "test" {
+		acl_test(*clients_file, flag.Args()[2:])
+		return
+	}
+	if flag.NArg() > 0 {
+		log.Fatalf("Unknown command %s", strings.Join(flag.Args(), " "))
+	}
+
+	clientsDB, err := dryred.ClientsDBFromToml(*clients_file)
+	if err != nil {
+		log.Fatalf("Cannot load clients from %s: %s", *clients_file, err.Error())
+	}
+
+	server, err := dryred.DRServerSSHNew(dryred.DRServerSSHConfig{
+		ClientsDB:                  clientsDB,
+		SSHServerKeyFileNames:      strings.Split(*key_files, ","),
+		SSHServerKeyPassphraseEnv:  "DR_SERVER_KEY_PASSPHRASE",
+		SSHServerKeyPassphraseFile: *passphrase_file,
+		AskPassphrase:              true,
+		HandshakeTimeout:           *handshake_timeout,
+		KeepAliveInterval:          *keepalive,
+		IdleTimeout:                *idle_timeout,
+		DropRevokedClients:         *drop_revoked,
+	})
+	if err != nil {
+		log.Fatalf("Cannot create server: %s", err.Error())
+	}
+
+	watch_clients(server, *clients_file, *reload_interval)
 
-	wg.Add(1)
 	install_signal(func() {
-		log.Printf("Caught Ctrl+C.")
+		log.Printf("Caught signal. Stopping..")
 		server.Stop()
-		//wg.Done()
 	})
 
-	log.Printf("Listening on port %d", *server_port);
-
-	// TODO: find a way to stop the server. Right now, it stops because main exits.
-	server.Run()
-	//wg.Wait()
+	log.Printf("Listening on %s", *listen_address)
+	server.ListenAndServe(*listen_address)
 }
@@ -0,0 +1,48 @@
+package dryred
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const backDialTimeout = 10 * time.Second
+
+// FWDialHandlerNew returns a FWSessionHandler for back clients, that dials the address requested
+// in every forwarded session and forwards the data both ways. Only the addresses in the allowed
+// list can be dialed, so front clients can't reach any other host from the back client network.
+// The addresses are of the form "host:port", e.g. "localhost:22" or "192.168.0.1:80".
+func FWDialHandlerNew(allowedAddresses []string) FWSessionHandler {
+	allowed := make(map[string]bool)
+	for _, address := range allowedAddresses {
+		allowed[address] = true
+	}
+
+	return func(session FWSession) {
+		address := session.Request().BackConnectionAddress
+
+		if !allowed[address] {
+			log.Printf("Refusing session to %s: address not allowed", address)
+			session.Reject(fmt.Sprintf("Address %s is not allowed", address))
+			return
+		}
+
+		targetConn, err := net.DialTimeout("tcp", address, backDialTimeout)
+		if err != nil {
+			log.Printf("Cannot connect to %s: %s", address, err.Error())
+			session.RejectWithCode(FWErrDialFailed, fmt.Sprintf("Cannot connect to %s", address))
+			return
+		}
+
+		frontConn, err := session.Accept()
+		if err != nil {
+			log.Printf("Cannot accept session to %s: %s", address, err.Error())
+			targetConn.Close()
+			return
+		}
+
+		log.Printf("Forwarding session to %s", address)
+		forwardConnections(frontConn, targetConn)
+	}
+}
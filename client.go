@@ -1,162 +1,714 @@
 package dryred
 
 import (
+	"context"
 	"net"
 	"golang.org/x/crypto/ssh"
-	"io/ioutil"
 	"fmt"
 	"log"
 	"encoding/json"
+	"os"
+	"sort"
+	"time"
 )
 
+// The forwardAddress of the connections is a host:port on the back client network, or the name of
+// a service advertised by the back client, e.g. ssh.
 type DRClient interface {
 	Connect(serverAddress string, backClientName string, forwardAddress string) (net.Conn, error)
 	ListenViaServer(string) (net.Conn, error)
+
+	// ConnectContext and ListenContext are Connect and ListenViaServer, bounded by the context
+	// through dialing, the SSH handshake and the requests to the server, until the connection is
+	// returned. The errors are *DRClientError, e.g. errors.Is(err, ErrBackClientOffline).
+	ConnectContext(ctx context.Context, serverAddress, backClientName, forwardAddress string) (net.Conn, error)
+	ListenContext(ctx context.Context, serverAddress string) (net.Conn, error)
+
+	// DialServerContext opens an authenticated connection to the server, on which many forwarded
+	// sessions can be opened without a new SSH handshake for each of them
+	DialServerContext(ctx context.Context, serverAddress string) (DRServerConn, error)
+
+	// ListBackClients returns the back clients this front client can forward to, with their
+	// status
+	ListBackClients(ctx context.Context, serverAddress string) ([]FWBackClient_V1, error)
+
+	// ServeViaServer registers as back client on the server and calls the handler, in its own
+	// goroutine, for every session forwarded by the server. All the sessions are multiplexed on
+	// the same connection. It returns when the connection to the server is lost.
+	ServeViaServer(serverAddress string, handler FWSessionHandler) error
+	// ServeViaServerContext is ServeViaServer, until the context is done. onRegistered, if not
+	// nil, is called once the server accepted the registration.
+	ServeViaServerContext(ctx context.Context, serverAddress string, handler FWSessionHandler,
+		onRegistered func()) error
+
+	// Listen registers as back client on the server, and returns the listener accepting the
+	// forwarded sessions, as FWConn. Closing the listener refuses the new sessions, but keeps
+	// the accepted ones open. The connection to the server is closed with the last of them.
+	Listen(serverAddress string) (net.Listener, error)
+}
+
+// DRServerConn is an authenticated front client connection to the server. The forwarded sessions
+// opened on it are multiplexed on it, and closed with it.
+type DRServerConn interface {
+	// ConnectContext opens a forwarded session to the back client. The context bounds only this
+	// session, not the connection.
+	ConnectContext(ctx context.Context, backClientName, forwardAddress string) (net.Conn, error)
+	ListBackClients(ctx context.Context) ([]FWBackClient_V1, error)
+	Close() error
+	// Wait blocks until the connection to the server is closed
+	Wait() error
 }
 
+// FWSession is a forwarded session requested by a front client, as seen by the back client.
+type FWSession interface {
+	// Request returns the connect request of the front client
+	Request() FWConnectRequest_V1
+	// Accept the session and return the connection to the front client
+	Accept() (net.Conn, error)
+	// Reject the session. The reason is sent back to the front client
+	Reject(reason string) error
+	// RejectWithCode rejects the session telling the front client why, e.g. FWErrDialFailed
+	RejectWithCode(code FWErrorCode, reason string) error
+}
+
+// FWSessionHandler is called by the back client for every new forwarded session
+type FWSessionHandler func(FWSession)
+
 type DRClientSSHConfig struct {
 	SSHKeyFileName string
+	// The passphrase of an encrypted key is SSHKeyPassPhrase, or else read from the
+	// SSHKeyPassPhraseEnv environment variable, or from the SSHKeyPassPhraseFile, or else asked
+	// on the terminal if AskPassPhrase is set
 	SSHKeyPassPhrase string
+	SSHKeyPassPhraseEnv string
+	SSHKeyPassPhraseFile string
+	AskPassPhrase bool
 	User string
+
+	// UseAgent authenticates with the keys held by the ssh-agent listening on SSH_AUTH_SOCK,
+	// offered before the key file
+	UseAgent bool
+	// AgentKey selects the agent key by its SHA256 fingerprint or its comment. By default, all
+	// the agent keys are offered.
+	AgentKey string
+
+	// HostKeyPolicy tells how the server key is verified, by default trusting it on first use
+	HostKeyPolicy HostKeyPolicy
+	// KnownHostsFile holds the trusted server keys, in OpenSSH known_hosts format. By default
+	// DefaultKnownHostsFile()
+	KnownHostsFile string
+	// ServerKeyFingerprint is the only server key accepted with HostKeyPinned, e.g.
+	// SHA256:K1WTUTfY6CWMAQEVk96J+YBJb+RiI6N11llKm3JjhOM
+	ServerKeyFingerprint string
+
+	// KeepAliveInterval is how often a back client checks that its connection to the server is
+	// alive. The connection is closed if the server doesn't answer within KeepAliveTimeout, by
+	// default KeepAliveInterval. No keepalives are sent if zero.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+
+	// Services are the named services of a back client, mapped to their address, e.g. ssh to
+	// localhost:22. The names are advertised to the server, and the front clients can connect to
+	// them by name.
+	Services map[string]string
+
+	// PeersDB holds the clients on the other end of the forwarded sessions. When set, an
+	// end-to-end SSH session authenticated with the same key is run with the peer over every
+	// forwarded session, so the server only sees encrypted data. Back clients with a PeersDB
+	// accept the end-to-end sessions, and also the plain ones, e.g. of ssh -J.
+	PeersDB ClientsDB
+	// RequireEndToEnd makes a back client refuse the sessions that are not end-to-end. It needs
+	// a PeersDB. The plain ssh -J and -W sessions through the server are never end-to-end, so
+	// they can't reach such a back client.
+	RequireEndToEnd bool
 }
 
 type sshDRClient struct {
 	sshConfig ssh.ClientConfig
 	config DRClientSSHConfig
+	signer ssh.Signer
 }
 
 func DRClientSSHNew(config DRClientSSHConfig) (DRClient, error) {
-	privateBytes, err := ioutil.ReadFile(config.SSHKeyFileName)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot read SSH private key: %s", err.Error())
+	var signers []ssh.Signer
+	var err error
+
+	if config.RequireEndToEnd && config.PeersDB == nil {
+		return nil, fmt.Errorf("End-to-end sessions required, but no peers are known")
+	}
+
+	if config.UseAgent {
+		signers, err = agentSigners(config.AgentKey)
+		if err != nil && config.SSHKeyFileName == "" {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("%s. Using the key file %s", err.Error(), config.SSHKeyFileName)
+		}
 	}
 
-	sshPrivateKey, err := ssh.ParsePrivateKeyWithPassphrase(privateBytes,
-		[]byte(config.SSHKeyPassPhrase))
+	// The key file is offered after the agent keys, and then loaded only if the server accepts it
+	var keyFileSigner ssh.Signer
+	if len(signers) == 0 {
+		keyFileSigner, err = fileSigner(config)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err = os.Stat(config.SSHKeyFileName); err == nil {
+		// Without the key file, e.g. the default one, only the agent keys are offered
+		keyFileSigner, err = loadSSHPrivateKeyLazily(config.SSHKeyFileName,
+			passphraseSource(config))
+		if err != nil {
+			log.Printf("Not using the key file: %s", err.Error())
+		}
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse private key: %s", err.Error())
+	// The end-to-end sessions use the selected agent key, or else the key file, or else the first
+	// agent key. The peers must know it.
+	signer := keyFileSigner
+	if len(signers) > 0 && (signer == nil || config.AgentKey != "") {
+		signer = signers[0]
+	}
+	if keyFileSigner != nil {
+		signers = append(signers, keyFileSigner)
 	}
 
 	sshConfig := ssh.ClientConfig{
 		User: config.User,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(sshPrivateKey)},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// TODO: ask the user here, or check known hosts
-			log.Printf("Automatically accepting server key %s",
-				ssh.FingerprintSHA256(key))
-			return nil
-		},
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return signers, nil
+		})},
+		HostKeyCallback: hostKeyCallback(config),
 	}
 	return &sshDRClient{
 		sshConfig: sshConfig,
 		config: config,
+		signer: signer,
 	}, nil
 }
 
-func buildSSHConnectionToServer(client *sshDRClient, serverAddress string) (ssh.Conn, net.Conn, error) {
-	conn, err := net.Dial("tcp", serverAddress)
-	should_close := false
+func fileSigner(config DRClientSSHConfig) (ssh.Signer, error) {
+	return loadSSHPrivateKey(config.SSHKeyFileName, passphraseSource(config))
+}
 
-	if err != nil {
-		return nil, nil, fmt.Errorf("Cannot connect to %s: %s", serverAddress, err.Error())
+func passphraseSource(config DRClientSSHConfig) sshKeyPassphrase {
+	return sshKeyPassphrase{
+		passphrase: config.SSHKeyPassPhrase,
+		envVar:     config.SSHKeyPassPhraseEnv,
+		file:       config.SSHKeyPassPhraseFile,
+		ask:        config.AskPassPhrase,
 	}
+}
+
+func buildSSHConnectionToServer(ctx context.Context, client *sshDRClient, serverAddress string) (ssh.Conn, net.Conn, <-chan ssh.NewChannel, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddress)
 
-	connWrapper := ConnWrapperNoCloserNew(conn, func(closingConnection net.Conn) error {
-		if should_close {
-			return conn.Close()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, nil, contextError(ctx, serverAddress)
 		}
-		return nil
-	})
+		return nil, nil, nil, clientError(ErrConnectionFailed, "Cannot connect to %s: %s",
+			serverAddress, err.Error())
+	}
 
-	sshConn, sshChans, sshReqs, err := ssh.NewClientConn(connWrapper, serverAddress,
-		&client.sshConfig)
+	watch := watchContext(ctx, conn)
+	sshConn, sshChans, sshReqs, err := ssh.NewClientConn(conn, serverAddress, &client.sshConfig)
+
+	if watch.Stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, nil, nil, contextError(ctx, serverAddress)
+	}
 
 	if err != nil {
 		conn.Close()
-		return nil, nil, fmt.Errorf("Cannot perform SSH connection %s", err.Error())
+		return nil, nil, nil, handshakeError(serverAddress, err)
 	}
 
-	// Discard the requests and channels. Server doesn't open channels or sends request to us
-	go discardSSHChans(sshChans)
+	// Discard the requests. Server doesn't send requests to us
 	go discardSSHRequests(sshReqs)
-	return sshConn, conn, nil
+	return sshConn, conn, sshChans, nil
 }
 
-func (client *sshDRClient)ListenViaServer(serverAddress string) (net.Conn, error) {
-	sshConn, tcpConn, err := buildSSHConnectionToServer(client, serverAddress)
+// registerBackClient sends the listen request to the server, and returns the channels the server
+// will open for the forwarded sessions.
+func registerBackClient(ctx context.Context, client *sshDRClient, serverAddress string) (ssh.Conn, net.Conn, <-chan ssh.NewChannel, error) {
+	sshConn, tcpConn, sshChans, err := buildSSHConnectionToServer(ctx, client, serverAddress)
 
 	if err != nil {
-		return nil, fmt.Errorf("Cannot create SSH secure connection to %s : %s",
-			serverAddress, err.Error())
+		return nil, nil, nil, fmt.Errorf("Cannot create SSH secure connection to %s : %w",
+			serverAddress, err)
+	}
+
+	hello, err := sayHello(ctx, sshConn, tcpConn, serverAddress)
+	if err != nil {
+		sshConn.Close()
+		return nil, nil, nil, err
+	}
+
+	var services []string
+	for name := range client.config.Services {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	serviceAddresses := client.config.Services
+
+	if len(services) > 0 && !hasCapability(hello.Capabilities, FWCapServices) {
+		log.Printf("Server %s doesn't support services. Not advertising %v", serverAddress,
+			services)
+		services = nil
+		serviceAddresses = nil
 	}
 
 	listenRequest, err := json.Marshal(FWListenRequest_V1{
 		Name: client.sshConfig.User,
+		Services: services,
+		ServiceAddresses: serviceAddresses,
 	})
 
 	if err != nil {
 		panic(err)
 	}
 
+	watch := watchContext(ctx, tcpConn)
 	_, data, err := sshConn.SendRequest(FWListenRequestName, true, listenRequest)
 
+	if watch.Stop() {
+		sshConn.Close()
+		return nil, nil, nil, contextError(ctx, serverAddress)
+	}
+
+	if err != nil && hello.Version == legacyHello.Version {
+		// The servers older than the hello request drop the back clients sending it
+		sshConn.Close()
+		return nil, nil, nil, clientError(ErrVersionMismatch,
+			"Server %s is too old for this back client. Upgrade it", serverAddress)
+	}
+
 	if err != nil {
-		return nil, fmt.Errorf("Cannot send listen request: ", err.Error())
+		sshConn.Close()
+		return nil, nil, nil, clientError(ErrConnectionFailed, "Cannot send listen request: %s",
+			err.Error())
 	}
 
 	var listenReply FWListenReply_V1
 	err = json.Unmarshal(data, &listenReply)
 
 	if err != nil {
-		return nil, fmt.Errorf("Cannot parse listen reply: ", err.Error())
+		sshConn.Close()
+		return nil, nil, nil, clientError(ErrConnectionFailed, "Cannot parse listen reply: %s",
+			err.Error())
 	}
 
 	if !listenReply.Status {
-		return nil, fmt.Errorf("Cannot listen connection. Reply: %s", string(data))
+		sshConn.Close()
+		return nil, nil, nil, codeError(listenReply.ErrorCode, listenReply.Retryable, ErrForbidden,
+			"Cannot listen connection: %s", listenReply.ErrorMessage)
+	}
+
+	if client.config.KeepAliveInterval > 0 {
+		timeout := client.config.KeepAliveTimeout
+		if timeout == 0 {
+			timeout = client.config.KeepAliveInterval
+		}
+		go keepAlive(sshConn, client.config.KeepAliveInterval, timeout)
+	}
+
+	return sshConn, tcpConn, sshChans, nil
+}
+
+// ListenViaServer waits for a single forwarded session and returns it. The connection to the
+// server is closed together with the returned connection.
+func (client *sshDRClient)ListenViaServer(serverAddress string) (net.Conn, error) {
+	return client.ListenContext(context.Background(), serverAddress)
+}
+
+func (client *sshDRClient) ListenContext(ctx context.Context, serverAddress string) (net.Conn, error) {
+	sshConn, tcpConn, sshChans, err := registerBackClient(ctx, client, serverAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The context also bounds the wait for the session
+	watch := watchContext(ctx, tcpConn)
+
+	for newChannel := range sshChans {
+		session, err := newFWSession(client, newChannel, tcpConn)
+		if err != nil {
+			log.Printf("Rejecting session: %s", err.Error())
+			continue
+		}
+
+		conn, err := session.Accept()
+		if watch.Stop() {
+			sshConn.Close()
+			return nil, contextError(ctx, serverAddress)
+		}
+		if err != nil {
+			sshConn.Close()
+			return nil, clientError(ErrConnectionFailed, "%w", err)
+		}
+
+		go func() {
+			// Only one session is served on this connection
+			for newChannel := range sshChans {
+				rejectWithCode(newChannel, ssh.ResourceShortage, FWErrQuotaExceeded,
+					"Back client is busy")
+			}
+		}()
+
+		return ConnWrapperNoCloserNew(conn, func(net.Conn) error {
+			conn.Close()
+			return sshConn.Close()
+		}), nil
 	}
 
 	sshConn.Close()
-	return tcpConn, nil
+	if watch.Stop() {
+		return nil, contextError(ctx, serverAddress)
+	}
+	return nil, clientError(ErrConnectionFailed,
+		"Connection to %s closed before any session was forwarded", serverAddress)
+}
+
+func (client *sshDRClient) ServeViaServer(serverAddress string, handler FWSessionHandler) error {
+	return client.ServeViaServerContext(context.Background(), serverAddress, handler, nil)
+}
+
+func (client *sshDRClient) ServeViaServerContext(ctx context.Context, serverAddress string, handler FWSessionHandler, onRegistered func()) error {
+	sshConn, tcpConn, sshChans, err := registerBackClient(ctx, client, serverAddress)
+
+	if err != nil {
+		return err
+	}
+	defer sshConn.Close()
+
+	if onRegistered != nil {
+		onRegistered()
+	}
+	watch := watchContext(ctx, tcpConn)
+
+	for newChannel := range sshChans {
+		session, err := newFWSession(client, newChannel, tcpConn)
+		if err != nil {
+			log.Printf("Rejecting session: %s", err.Error())
+			continue
+		}
+		go handler(session)
+	}
+
+	if watch.Stop() {
+		return contextError(ctx, serverAddress)
+	}
+	return clientError(ErrConnectionFailed, "Connection to %s closed: %v", serverAddress,
+		sshConn.Wait())
+}
+
+type sshFWSession struct {
+	client     *sshDRClient
+	newChannel ssh.NewChannel
+	request    FWConnectRequest_V1
+	tcpConn    net.Conn
+}
+
+// newFWSession parses the forwarded session request sent by the server. Anything else than a
+// forward channel is rejected.
+func newFWSession(client *sshDRClient, newChannel ssh.NewChannel, tcpConn net.Conn) (FWSession, error) {
+	if newChannel.ChannelType() != FWForwardChannelName {
+		newChannel.Reject(ssh.UnknownChannelType, "Unknown channel type")
+		return nil, fmt.Errorf("Unknown channel type %s", newChannel.ChannelType())
+	}
+
+	var request FWConnectRequest_V1
+	if err := json.Unmarshal(newChannel.ExtraData(), &request); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "Cannot parse the connect request")
+		return nil, fmt.Errorf("Cannot parse the connect request: %s", err.Error())
+	}
+
+	if client.config.RequireEndToEnd && !request.EndToEnd {
+		rejectWithCode(newChannel, ssh.Prohibited, FWErrForbiddenTarget,
+			"End-to-end session required")
+		return nil, fmt.Errorf("Session to %s is not end-to-end",
+			request.BackConnectionAddress)
+	}
+
+	if request.ServiceName != "" {
+		address, ok := client.config.Services[request.ServiceName]
+		if !ok {
+			rejectWithCode(newChannel, ssh.Prohibited, FWErrForbiddenTarget,
+				"Unknown service "+request.ServiceName)
+			return nil, fmt.Errorf("Unknown service %s", request.ServiceName)
+		}
+		request.BackConnectionAddress = address
+	}
+
+	if client.config.PeersDB == nil && request.EndToEnd {
+		rejectWithCode(newChannel, ssh.Prohibited, FWErrForbiddenTarget,
+			"End-to-end session not supported")
+		return nil, fmt.Errorf("Session to %s is end-to-end, but no peers are known",
+			request.BackConnectionAddress)
+	}
+
+	return &sshFWSession{
+		client:     client,
+		newChannel: newChannel,
+		request:    request,
+		tcpConn:    tcpConn,
+	}, nil
+}
+
+func (session *sshFWSession) Request() FWConnectRequest_V1 {
+	return session.request
+}
+
+func (session *sshFWSession) Accept() (net.Conn, error) {
+	channel, reqs, err := session.newChannel.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot accept the session: %s", err.Error())
+	}
+	go ssh.DiscardRequests(reqs)
+
+	conn := sshChannelConnNew(channel, session.tcpConn.LocalAddr(),
+		session.tcpConn.RemoteAddr(), nil)
+
+	if session.request.EndToEnd {
+		return endToEndServerConn(session.client, conn)
+	}
+	return conn, nil
+}
+
+func (session *sshFWSession) Reject(reason string) error {
+	return session.RejectWithCode(FWErrForbiddenTarget, reason)
+}
+
+func (session *sshFWSession) RejectWithCode(code FWErrorCode, reason string) error {
+	return rejectWithCode(session.newChannel, ssh.Prohibited, code, reason)
 }
 
 func (client *sshDRClient)Connect(serverAddress, backClient, backAddress string) (net.Conn, error) {
-	sshConn, tcpConn, err := buildSSHConnectionToServer(client, serverAddress)
+	return client.ConnectContext(context.Background(), serverAddress, backClient, backAddress)
+}
 
+func (client *sshDRClient) ConnectContext(ctx context.Context, serverAddress, backClient, backAddress string) (net.Conn, error) {
+	serverConn, err := client.dialServer(ctx, serverAddress)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot create SSH secure connection to %s : %s",
-			serverAddress, err.Error())
+		return nil, err
 	}
 
-	fwRequest, err := json.Marshal(FWConnectRequest_V1{
-		BackClientName: backClient,
-		BackConnectionAddress: backAddress,
-	})
+	// The connection to the server is used for this session only
+	conn, err := serverConn.connect(ctx, backClient, backAddress, serverConn.Close)
+	if err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (client *sshDRClient) DialServerContext(ctx context.Context, serverAddress string) (DRServerConn, error) {
+	return client.dialServer(ctx, serverAddress)
+}
+
+func (client *sshDRClient) dialServer(ctx context.Context, serverAddress string) (*sshServerConn, error) {
+	sshConn, tcpConn, sshChans, err := buildSSHConnectionToServer(ctx, client, serverAddress)
 
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Cannot create SSH secure connection to %s : %w",
+			serverAddress, err)
+	}
+	// Server doesn't open channels towards front clients
+	go discardSSHChans(sshChans)
+
+	hello, err := sayHello(ctx, sshConn, tcpConn, serverAddress)
+	if err != nil {
+		sshConn.Close()
+		return nil, err
 	}
 
-	_, data, err := sshConn.SendRequest(FWConnectRequestName, true, fwRequest)
+	return &sshServerConn{
+		client:        client,
+		serverAddress: serverAddress,
+		sshConn:       sshConn,
+		tcpConn:       tcpConn,
+		hello:         hello,
+	}, nil
+}
 
+func (client *sshDRClient) ListBackClients(ctx context.Context, serverAddress string) ([]FWBackClient_V1, error) {
+	serverConn, err := client.dialServer(ctx, serverAddress)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot send request for %s, to %s: ", backClient,
-			backAddress, err.Error())
+		return nil, err
 	}
+	defer serverConn.Close()
 
-	var fwReply FWConnectReply_V1
-	err = json.Unmarshal(data, &fwReply)
+	return serverConn.ListBackClients(ctx)
+}
+
+type sshServerConn struct {
+	client        *sshDRClient
+	serverAddress string
+	sshConn       ssh.Conn
+	tcpConn       net.Conn
+	// The protocol version and the capabilities agreed with the server
+	hello FWHelloReply_V1
+}
 
+func (serverConn *sshServerConn) ConnectContext(ctx context.Context, backClient, backAddress string) (net.Conn, error) {
+	return serverConn.connect(ctx, backClient, backAddress, nil)
+}
+
+func (serverConn *sshServerConn) Close() error {
+	return serverConn.sshConn.Close()
+}
+
+func (serverConn *sshServerConn) Wait() error {
+	return serverConn.sshConn.Wait()
+}
+
+type sendRequestResult struct {
+	ok    bool
+	reply []byte
+	err   error
+}
+
+func (serverConn *sshServerConn) ListBackClients(ctx context.Context) ([]FWBackClient_V1, error) {
+	if !hasCapability(serverConn.hello.Capabilities, FWCapList) {
+		return nil, clientError(ErrVersionMismatch, "Server %s can't list the back clients",
+			serverConn.serverAddress)
+	}
+
+	listRequest, err := json.Marshal(FWListRequest_V1{})
 	if err != nil {
-		return nil, fmt.Errorf("Cannot parse fw reply for %s, to %s: ", backClient,
-			backAddress, err.Error())
+		panic(err)
 	}
 
-	if !fwReply.Status {
-		return nil, fmt.Errorf("Cannot open a fw connection. Reply: %s",
-			string(data))
+	results := make(chan sendRequestResult, 1)
+	go func() {
+		ok, reply, err := serverConn.sshConn.SendRequest(FWListRequestName, true, listRequest)
+		results <- sendRequestResult{ok, reply, err}
+	}()
+
+	var result sendRequestResult
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return nil, contextError(ctx, serverConn.serverAddress)
 	}
 
-	sshConn.Close()
-	return tcpConn, nil
-}
\ No newline at end of file
+	if result.err != nil {
+		return nil, clientError(ErrConnectionFailed, "Cannot send list request: %s",
+			result.err.Error())
+	}
+
+	// The refusal carries the reply with the error code, unless the server is older than it
+	var listReply FWListReply_V1
+	if err := json.Unmarshal(result.reply, &listReply); err != nil {
+		if !result.ok {
+			return nil, clientError(ErrForbidden, "The server refused the list request")
+		}
+		return nil, clientError(ErrConnectionFailed, "Cannot parse list reply: %s",
+			err.Error())
+	}
+	if !result.ok || !listReply.Status {
+		return nil, codeError(listReply.ErrorCode, listReply.Retryable, ErrForbidden,
+			"Cannot list the back clients: %s", listReply.ErrorMessage)
+	}
+	return listReply.BackClients, nil
+}
+
+type openChannelResult struct {
+	channel ssh.Channel
+	reqs    <-chan *ssh.Request
+	err     error
+}
+
+// connect opens a forwarded session on the connection. onClose is called when the returned
+// connection is closed.
+func (serverConn *sshServerConn) connect(ctx context.Context, backClient, backAddress string, onClose func() error) (net.Conn, error) {
+	client := serverConn.client
+
+	request := FWConnectRequest_V1{
+		BackClientName: backClient,
+		BackConnectionAddress: backAddress,
+		EndToEnd: client.config.PeersDB != nil,
+	}
+	// Never fall back to a session the server can read
+	if request.EndToEnd && !hasCapability(serverConn.hello.Capabilities, FWCapEndToEnd) {
+		return nil, clientError(ErrVersionMismatch,
+			"Server %s doesn't forward end-to-end sessions", serverConn.serverAddress)
+	}
+	// Addresses always have a port, and service names never do
+	if _, _, err := net.SplitHostPort(backAddress); err != nil {
+		if !hasCapability(serverConn.hello.Capabilities, FWCapServices) {
+			return nil, clientError(ErrVersionMismatch,
+				"Server %s can't connect to the service %s by name", serverConn.serverAddress,
+				backAddress)
+		}
+		request.BackConnectionAddress = ""
+		request.ServiceName = backAddress
+	}
+
+	fwRequest, err := json.Marshal(request)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Other sessions can share the connection, so the context can't close it. Leave the open
+	// request behind instead, and close its channel if it's opened after all.
+	results := make(chan openChannelResult, 1)
+	go func() {
+		channel, reqs, err := serverConn.sshConn.OpenChannel(FWConnectChannelName, fwRequest)
+		results <- openChannelResult{channel, reqs, err}
+	}()
+
+	var result openChannelResult
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		go func() {
+			if result := <-results; result.err == nil {
+				result.channel.Close()
+			}
+		}()
+		return nil, contextError(ctx, serverConn.serverAddress)
+	}
+
+	if err = result.err; err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			var fwReply FWConnectReply_V1
+			if json.Unmarshal([]byte(openErr.Message), &fwReply) != nil {
+				return nil, rejectionError(openErr, "Cannot parse fw reply for %s, to %s: %s",
+					backClient, backAddress, openErr.Message)
+			}
+			return nil, codeError(fwReply.ErrorCode, fwReply.Retryable, rejectionKind(openErr),
+				"Cannot open a fw connection to %s, %s: %s", backClient, backAddress,
+				fwReply.ErrorMessage)
+		}
+
+		return nil, clientError(ErrConnectionFailed, "Cannot send request for %s, to %s: %s",
+			backClient, backAddress, err.Error())
+	}
+	go ssh.DiscardRequests(result.reqs)
+
+	conn := sshChannelConnNew(result.channel, serverConn.tcpConn.LocalAddr(),
+		serverConn.tcpConn.RemoteAddr(), onClose)
+
+	if client.config.PeersDB == nil {
+		return conn, nil
+	}
+
+	// The context bounds the end-to-end handshake too
+	watch := watchContext(ctx, conn)
+	e2eConn, err := endToEndClientConn(client, conn, backClient)
+	if watch.Stop() {
+		conn.Close()
+		return nil, contextError(ctx, serverConn.serverAddress)
+	}
+	if err != nil {
+		return nil, clientError(ErrEndToEndFailed, "%w", err)
+	}
+	return e2eConn, nil
+}
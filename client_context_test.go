@@ -0,0 +1,84 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDRClientContextErrors(t *testing.T) {
+	const serverAddress string = "localhost:7015"
+	const silentAddress string = "localhost:7016"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	unknownClient := testClient(t, "testdata/server_id_rsa", "elisescu")
+
+	ctx := context.Background()
+
+	_, err := frontClient.ConnectContext(ctx, serverAddress, "pi", "localhost:22")
+	if !errors.Is(err, ErrBackClientOffline) {
+		t.Fatalf("Expected the back client to be offline, got: %v", err)
+	}
+
+	_, err = frontClient.ConnectContext(ctx, serverAddress, "nobody", "localhost:22")
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected the forwarding to be forbidden, got: %v", err)
+	}
+
+	_, err = unknownClient.ConnectContext(ctx, serverAddress, "pi", "localhost:22")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Expected the authentication to fail, got: %v", err)
+	}
+
+	// A server accepting connections, but never answering the SSH handshake
+	listener, err := net.Listen("tcp", silentAddress)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", silentAddress, err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = frontClient.ConnectContext(timeoutCtx, silentAddress, "pi", "localhost:22")
+	var clientErr *DRClientError
+	if !errors.Is(err, ErrTimeout) || !errors.As(err, &clientErr) || !clientErr.Timeout() {
+		t.Fatalf("Expected a timeout, got: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("The connect timeout was not honoured")
+	}
+
+	// Canceling the context stops waiting for a session
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	_, err = backClient.ListenContext(cancelCtx, serverAddress)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the listen to be canceled, got: %v", err)
+	}
+
+	// The back client is offline again once its listen is canceled
+	time.Sleep(100 * time.Millisecond)
+	_, err = frontClient.ConnectContext(ctx, serverAddress, "pi", "localhost:22")
+	if !errors.Is(err, ErrBackClientOffline) {
+		t.Fatalf("Expected the back client to be offline, got: %v", err)
+	}
+}
@@ -1,12 +1,71 @@
 package dryred
 
 import (
+	"context"
 	"log"
 	"time"
 	"testing"
 	"net"
+	"strings"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"fmt"
+	"golang.org/x/crypto/ssh"
 )
 
+func startTestServer(t *testing.T, address string) DRServer {
+	clientsDB , err := ClientsDBFromToml("testdata/clients.toml")
+	if err != nil {
+		t.Fatal("Cant read the clients.toml file: ", err)
+	}
+	server , err := DRServerSSHNew(DRServerSSHConfig{
+		SSHServerKeyPassphrase: "TestTest",
+		SSHServerKeyFileName: "testdata/server_id_rsa",
+		ClientsDB: clientsDB,
+	})
+	if err != nil {
+		t.Fatal("Can't create server: ", err)
+	}
+	go server.ListenAndServe(address)
+	time.Sleep(100 * time.Millisecond)
+	return server
+}
+
+// startEchoServer starts a TCP server that echoes back all the data it receives
+func startEchoServer(t *testing.T, address string) net.Listener {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", address, err.Error())
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func testClient(t *testing.T, keyFile, user string) DRClient {
+	client, err := DRClientSSHNew(DRClientSSHConfig{
+		SSHKeyFileName: keyFile,
+		SSHKeyPassPhrase: "TestTest",
+		User: user,
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
+	})
+	if err != nil {
+		t.Fatalf("Can't create client %s: %s", user, err.Error())
+	}
+	return client
+}
+
 func TestDRServer(t *testing.T) {
 	const serverAddress string = "localhost:7000"
 	const destAddress string = "localhost:7001"
@@ -30,16 +89,20 @@ func TestDRServer(t *testing.T) {
 	}
 	log.Printf("Starting server on :7000")
 	go server.ListenAndServe(":7000")
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
 
 	frontClientConfig := DRClientSSHConfig{
 		SSHKeyFileName:"testdata/front_id_rsa",
 		SSHKeyPassPhrase:"TestTest",
 		User:"elisescu",
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
 	}
 	backClientConfig := DRClientSSHConfig{
 		SSHKeyFileName:"testdata/back_id_rsa",
 		SSHKeyPassPhrase:"TestTest",
 		User:"pi",
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
 	}
 
 
@@ -51,20 +114,397 @@ func TestDRServer(t *testing.T) {
 		t.Fatal("Can't create back client: ", err)
 	}
 
+	if _, err = frontClient.Connect(serverAddress, backClientConfig.User, destAddress); err == nil {
+		t.Fatal("Connected to a back client that is offline")
+	}
+
+	// ListenViaServer returns only once a front client is forwarded to it
+	backConns := make(chan net.Conn)
+	go func() {
+		conn, err := backClient.ListenViaServer(serverAddress)
+		if err != nil {
+			t.Errorf("Can't listen via the server: %s", err.Error())
+		}
+		backConns <- conn
+	}()
+	time.Sleep(100 * time.Millisecond)
 
-	if backConn, err = backClient.ListenViaServer(serverAddress); err != nil {
-		t.Fatalf("Can't listen via the server: %s", err.Error())
+	if _, err = frontClient.Connect(serverAddress, frontClientConfig.User, destAddress); err == nil {
+		t.Fatal("Connected to a front client")
 	}
 
 	if frontConn, err = frontClient.Connect(serverAddress, backClientConfig.User, destAddress); err != nil {
 		t.Fatalf("Can't connect to the remote back address: %s", err.Error())
 	}
+	defer frontConn.Close()
+
+	if backConn = <-backConns; backConn == nil {
+		t.FailNow()
+	}
+	defer backConn.Close()
+
+	// The back client listens for a single session, which is now used by the front client
+	if _, err = frontClient.Connect(serverAddress, backClientConfig.User, destAddress); err == nil {
+		t.Fatal("Connected twice to the same back connection")
+	}
+}
+
+func TestDRServerMultiplexedSessions(t *testing.T) {
+	const serverAddress string = "localhost:7002"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+
+	sessions := make(chan FWConnectRequest_V1, 10)
+	go backClient.ServeViaServer(serverAddress, func(session FWSession) {
+		if session.Request().BackConnectionAddress == "localhost:1" {
+			session.Reject("target not allowed")
+			return
+		}
+		conn, err := session.Accept()
+		if err != nil {
+			t.Errorf("Can't accept session: %s", err.Error())
+			return
+		}
+		sessions <- session.Request()
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	time.Sleep(100 * time.Millisecond)
 
-	time.Sleep(200 * time.Second)
+	var frontConns []net.Conn
+	for i := 0; i < 3; i++ {
+		frontConn, err := frontClient.Connect(serverAddress, "pi", "localhost:22")
+		if err != nil {
+			t.Fatalf("Can't connect to the back client: %s", err.Error())
+		}
+		defer frontConn.Close()
+		frontConns = append(frontConns, frontConn)
 
-	backConn.Close()
-	frontConn.Close()
-	server.Stop()
+		select {
+		case request := <-sessions:
+			if request.BackConnectionAddress != "localhost:22" {
+				t.Fatalf("Wrong address forwarded: %s", request.BackConnectionAddress)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Back client didn't get the session")
+		}
+	}
+
+	// All the sessions are open at the same time and carry their own data
+	for i, frontConn := range frontConns {
+		input := []byte(fmt.Sprintf("hello from session %d", i))
+		if _, err := frontConn.Write(input); err != nil {
+			t.Fatalf("Can't write to session %d: %s", i, err.Error())
+		}
+		output := make([]byte, len(input))
+		if _, err := io.ReadFull(frontConn, output); err != nil {
+			t.Fatalf("Can't read from session %d: %s", i, err.Error())
+		}
+		if !slice_eq(input, output) {
+			t.Fatalf("Session %d echoed %q instead of %q", i, output, input)
+		}
+	}
+
+	_, err := frontClient.Connect(serverAddress, "pi", "localhost:1")
+	if err == nil || !strings.Contains(err.Error(), "target not allowed") {
+		t.Fatalf("Expected the back client to refuse the session, got: %v", err)
+	}
+}
+
+func TestDRServerEndToEndSession(t *testing.T) {
+	const serverAddress string = "localhost:7003"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	peersDB, err := ClientsDBFromToml("testdata/clients.toml")
+	if err != nil {
+		t.Fatal("Cant read the clients.toml file: ", err)
+	}
+
+	frontClient, err := DRClientSSHNew(DRClientSSHConfig{
+		SSHKeyFileName: "testdata/front_id_rsa",
+		SSHKeyPassPhrase: "TestTest",
+		User: "elisescu",
+		PeersDB: peersDB,
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
+	})
+	if err != nil {
+		t.Fatal("Can't create front client: ", err)
+	}
+	backClient, err := DRClientSSHNew(DRClientSSHConfig{
+		SSHKeyFileName: "testdata/back_id_rsa",
+		SSHKeyPassPhrase: "TestTest",
+		User: "pi",
+		PeersDB: peersDB,
+		RequireEndToEnd: true,
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
+	})
+	if err != nil {
+		t.Fatal("Can't create back client: ", err)
+	}
+
+	go backClient.ServeViaServer(serverAddress, func(session FWSession) {
+		conn, err := session.Accept()
+		if err != nil {
+			t.Errorf("Can't accept end-to-end session: %s", err.Error())
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	frontConn, err := frontClient.Connect(serverAddress, "pi", "localhost:22")
+	if err != nil {
+		t.Fatalf("Can't open end-to-end session: %s", err.Error())
+	}
+	defer frontConn.Close()
+
+	input := []byte("end-to-end hello")
+	if _, err := frontConn.Write(input); err != nil {
+		t.Fatalf("Can't write to the end-to-end session: %s", err.Error())
+	}
+	output := make([]byte, len(input))
+	if _, err := io.ReadFull(frontConn, output); err != nil {
+		t.Fatalf("Can't read from the end-to-end session: %s", err.Error())
+	}
+	if !slice_eq(input, output) {
+		t.Fatalf("End-to-end session echoed %q instead of %q", output, input)
+	}
+
+	// A front client without peers can't open a session to a back client requiring end-to-end
+	if _, err = testClient(t, "testdata/front_id_rsa", "elisescu").Connect(serverAddress, "pi",
+		"localhost:22"); err == nil {
+		t.Fatal("Opened a session that is not end-to-end")
+	}
+}
 
-	time.Sleep(2 * time.Second)
+func TestDRBackClientDialsAllowedAddresses(t *testing.T) {
+	const serverAddress string = "localhost:7004"
+	const targetAddress string = "localhost:7005"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	defer startEchoServer(t, targetAddress).Close()
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{targetAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	frontConn, err := frontClient.Connect(serverAddress, "pi", targetAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the allowed address: %s", err.Error())
+	}
+	defer frontConn.Close()
+
+	input := []byte("hello target")
+	if _, err := frontConn.Write(input); err != nil {
+		t.Fatalf("Can't write to the target: %s", err.Error())
+	}
+	output := make([]byte, len(input))
+	if _, err := io.ReadFull(frontConn, output); err != nil {
+		t.Fatalf("Can't read from the target: %s", err.Error())
+	}
+	if !slice_eq(input, output) {
+		t.Fatalf("Target echoed %q instead of %q", output, input)
+	}
+
+	_, err = frontClient.Connect(serverAddress, "pi", "localhost:7006")
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Expected the address to be refused, got: %v", err)
+	}
+}
+
+func TestDRForwarder(t *testing.T) {
+	const serverAddress string = "localhost:7007"
+	const targetAddress string = "localhost:7008"
+	const localAddress string = "localhost:7009"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+	defer startEchoServer(t, targetAddress).Close()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{targetAddress}))
+
+	forwarder := DRForwarderNew(DRForwarderConfig{
+		Client: testClient(t, "testdata/front_id_rsa", "elisescu"),
+		ServerAddress: serverAddress,
+		BackClientName: "pi",
+		BackConnectionAddress: targetAddress,
+	})
+	stopped := make(chan error)
+	go func() {
+		stopped <- forwarder.ListenAndServe(localAddress)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	var localConns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", localAddress)
+		if err != nil {
+			t.Fatalf("Can't connect to the forwarder: %s", err.Error())
+		}
+		defer conn.Close()
+		localConns = append(localConns, conn)
+	}
+
+	for i, conn := range localConns {
+		input := []byte(fmt.Sprintf("forwarded connection %d", i))
+		if _, err := conn.Write(input); err != nil {
+			t.Fatalf("Can't write to forwarded connection %d: %s", i, err.Error())
+		}
+		output := make([]byte, len(input))
+		if _, err := io.ReadFull(conn, output); err != nil {
+			t.Fatalf("Can't read from forwarded connection %d: %s", i, err.Error())
+		}
+		if !slice_eq(input, output) {
+			t.Fatalf("Connection %d echoed %q instead of %q", i, output, input)
+		}
+	}
+
+	forwarder.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forwarder didn't stop")
+	}
+
+	// Stopping closes the forwarded connections too
+	localConns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := localConns[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Forwarded connection still open after Stop: %v", err)
+	}
+}
+
+// jumpHostDialer returns what a plain ssh -J or -W does with the front client key: a
+// direct-tcpip channel to the back client, via the server
+func jumpHostDialer(t *testing.T, serverAddress string) func(user, address string) (net.Conn, error) {
+	keyBytes, err := ioutil.ReadFile("testdata/front_id_rsa")
+	if err != nil {
+		t.Fatal("Can't read front key: ", err)
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte("TestTest"))
+	if err != nil {
+		t.Fatal("Can't parse front key: ", err)
+	}
+
+	return func(user, address string) (net.Conn, error) {
+		sshClient, err := ssh.Dial("tcp", serverAddress, &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		conn, err := sshClient.Dial("tcp", address)
+		if err != nil {
+			sshClient.Close()
+		}
+		return conn, err
+	}
+}
+
+func TestDRServerAsJumpHost(t *testing.T) {
+	const serverAddress string = "localhost:7010"
+	const targetAddress string = "localhost:7011"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+	defer startEchoServer(t, targetAddress).Close()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{targetAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	jump := jumpHostDialer(t, serverAddress)
+
+	for user, address := range map[string]string{
+		"elisescu:pi": targetAddress,
+		"elisescu": "pi:7011",
+	} {
+		conn, err := jump(user, address)
+		if err != nil {
+			t.Fatalf("Can't jump as %s to %s: %s", user, address, err.Error())
+		}
+
+		input := []byte("hello via jump host")
+		conn.Write(input)
+		output := make([]byte, len(input))
+		if _, err := io.ReadFull(conn, output); err != nil || !slice_eq(input, output) {
+			t.Fatalf("Jump as %s to %s echoed %q: %v", user, address, output, err)
+		}
+		conn.Close()
+	}
+
+	if _, err := jump("pi:pi", targetAddress); err == nil {
+		t.Fatal("Authenticated with a key of another client")
+	}
+}
+
+func TestDRServerAsJumpHostToEndToEndBackClient(t *testing.T) {
+	const serverAddress string = "localhost:7042"
+	const targetAddress string = "localhost:7043"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+	defer startEchoServer(t, targetAddress).Close()
+
+	peersDB, err := ClientsDBFromToml("testdata/clients.toml")
+	if err != nil {
+		t.Fatal("Cant read the clients.toml file: ", err)
+	}
+	backClientWith := func(requireEndToEnd bool) DRClient {
+		backClient, err := DRClientSSHNew(DRClientSSHConfig{
+			SSHKeyFileName: "testdata/back_id_rsa",
+			SSHKeyPassPhrase: "TestTest",
+			User: "pi",
+			PeersDB: peersDB,
+			RequireEndToEnd: requireEndToEnd,
+			KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
+		})
+		if err != nil {
+			t.Fatal("Can't create back client: ", err)
+		}
+		return backClient
+	}
+	jump := jumpHostDialer(t, serverAddress)
+
+	// A back client with peers still serves the plain sessions of ssh -J
+	ctx, cancel := context.WithCancel(context.Background())
+	go backClientWith(false).ServeViaServerContext(ctx, serverAddress,
+		FWDialHandlerNew([]string{targetAddress}), nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := jump("elisescu:pi", targetAddress)
+	if err != nil {
+		t.Fatalf("Can't jump to the back client with peers: %s", err.Error())
+	}
+	input := []byte("hello via jump host")
+	conn.Write(input)
+	output := make([]byte, len(input))
+	if _, err := io.ReadFull(conn, output); err != nil || !slice_eq(input, output) {
+		t.Fatalf("Jump to the back client with peers echoed %q: %v", output, err)
+	}
+	conn.Close()
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// Unless it requires end-to-end sessions
+	go backClientWith(true).ServeViaServer(serverAddress,
+		FWDialHandlerNew([]string{targetAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err = jump("elisescu:pi", targetAddress); err == nil {
+		t.Fatal("Jumped to a back client requiring end-to-end sessions")
+	}
 }
@@ -1,5 +1,9 @@
 package dryred
 
+import (
+	"time"
+)
+
 type ClientsDB interface {
 	// FindClientByName finds the client in the data base by its name and returns a ClientInfo
 	// interface, if found, or nil otherwise.
@@ -7,12 +11,23 @@ type ClientsDB interface {
 
 	// FindClientByPubKey finds the client in the data base by its public key and returns a
 	// ClientInfo interface, if found, or nil otherwise.
-	// The public key format has to be of the form: "keyTypeString keyData"
+	// The public key format has to be of the form: "keyTypeString keyData", and it has to match
+	// the key of the client exactly.
 	FindClientByPubKey(string) (ClientInfo)
 
 	// ForwardAllowedFromTo returns true if first client is allowed to forward data to the
-	// second one.
+	// second one, at least to some targets.
 	ForwardAllowedFromTo(ClientInfo, ClientInfo) bool
+
+	// CheckForward decides if the front client can forward to the target of the back client,
+	// at the given time
+	CheckForward(from, to ClientInfo, target ForwardTarget, at time.Time) ForwardDecision
+
+	// BackClients returns all the back clients in the data base
+	BackClients() []ClientInfo
+
+	// Clients returns all the clients in the data base, front and back
+	Clients() []ClientInfo
 }
 
 type ClientInfo interface {
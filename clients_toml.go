@@ -2,8 +2,9 @@ package dryred
 
 import (
 	"github.com/elisescu/toml"
+	"golang.org/x/crypto/ssh"
 	"fmt"
-	"strings"
+	"time"
 )
 
 type clientToml struct {
@@ -15,6 +16,9 @@ type dbToml struct {
 	// Don't change these two variables - they are filled in vya toml DecodeFile
 	To   []clientToml
 	From []clientToml
+	// The forwarding rules, see acl.go
+	Groups map[string][]string
+	Rule   []ruleToml
 }
 
 type clientInfo struct {
@@ -23,8 +27,17 @@ type clientInfo struct {
 	front bool
 }
 
+// clientsDB is indexed at load time, so the lookups on every handshake don't depend on the number
+// of clients
 type clientsDB struct {
-	clients dbToml
+	// By the SHA256 fingerprint of the public key, and by name
+	byFingerprint map[string]*clientInfo
+	byName        map[string]*clientInfo
+	// The clients, and only the back ones, in the file order
+	clients     []ClientInfo
+	backClients []ClientInfo
+	// The forwarding rules, in the file order. None allows all.
+	rules []*aclRule
 }
 
 func (client *clientInfo)Name() string {
@@ -38,67 +51,164 @@ func (client *clientInfo)PubKey() string {
 func (client *clientInfo)FrontClient() bool {
 	return client.front
 }
-// TODO: avoid code duplication and use a lambda as search criteria
+// FindClientByPubKey matches the key exactly. The comment after the key data is ignored.
 func (db *clientsDB) FindClientByPubKey(pubKey string) (ClientInfo) {
-	for _, client := range db.clients.From {
-		if strings.HasPrefix(client.Public_key, pubKey) {
-			return &clientInfo{
-				name: client.Client_name,
-				pubKey: client.Public_key,
-				front: true,
-			}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil
+	}
+
+	client, ok := db.byFingerprint[ssh.FingerprintSHA256(key)]
+	if !ok || client.pubKey != encodeSSHPubKey(key) {
+		return nil
+	}
+	return client
+}
+
+func (db *clientsDB) FindClientByName(name string) (ClientInfo) {
+	client, ok := db.byName[name]
+	if !ok {
+		return nil
+	}
+	return client
+}
+
+func (db *clientsDB) BackClients() []ClientInfo {
+	return append([]ClientInfo(nil), db.backClients...)
+}
+
+func (db *clientsDB) Clients() []ClientInfo {
+	return append([]ClientInfo(nil), db.clients...)
+}
+
+// ForwardAllowedFromTo tells if the rules allow some targets of the back client, some of the time
+func (db *clientsDB) ForwardAllowedFromTo(client1 ClientInfo, client2 ClientInfo) bool {
+	if !client1.FrontClient() || client2.FrontClient() {
+		return false
+	}
+	if db.rules == nil {
+		return true
+	}
+
+	for _, rule := range db.rules {
+		if !rule.matchesClients(client1, client2) {
+			continue
+		}
+		// A conditional deny can still leave other targets allowed
+		if rule.allow || !rule.conditional() {
+			return rule.allow
 		}
 	}
+	return false
+}
 
-	for _, client := range db.clients.To {
-		if strings.HasPrefix(client.Public_key, pubKey) {
-			return &clientInfo{
-				name: client.Client_name,
-				pubKey: client.Public_key,
-				front: false,
-			}
+func (db *clientsDB) CheckForward(from, to ClientInfo, target ForwardTarget, at time.Time) ForwardDecision {
+	if !from.FrontClient() || to.FrontClient() {
+		return ForwardDecision{Rule: "only front clients can forward to back clients"}
+	}
+	if db.rules == nil {
+		return ForwardDecision{Allowed: true, Rule: "no rules, all allowed"}
+	}
+
+	if target.Address != "" {
+		address, err := normalizeACLAddress(target.Address)
+		if err != nil {
+			return ForwardDecision{Rule: fmt.Sprintf("bad address %s: %s", target.Address,
+				err.Error())}
 		}
+		target.Address = address
 	}
 
-	return nil
+	for _, rule := range db.rules {
+		if rule.matches(from, to, target, at) {
+			return ForwardDecision{Allowed: rule.allow, Rule: rule.text}
+		}
+	}
+	return ForwardDecision{Rule: "no rule matched, denied by default"}
 }
 
-func (db *clientsDB) FindClientByName(name string) (ClientInfo) {
-	for _, client := range db.clients.From {
-		if client.Client_name == name {
-			return &clientInfo{
-				name: client.Client_name,
-				pubKey: client.Public_key,
-				front: true,
-			}
+func ClientsDBFromToml(file string) (ClientsDB, error) {
+	var clients dbToml
+	_, err := toml.DecodeFile(file, &clients)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse file: %s", err.Error())
+
+	}
+
+	db := &clientsDB{
+		byFingerprint: make(map[string]*clientInfo),
+		byName:        make(map[string]*clientInfo),
+	}
+	for _, client := range clients.From {
+		if err := db.add(client, true); err != nil {
+			return nil, fmt.Errorf("Invalid clients file %s: %s", file, err.Error())
+		}
+	}
+	for _, client := range clients.To {
+		if err := db.add(client, false); err != nil {
+			return nil, fmt.Errorf("Invalid clients file %s: %s", file, err.Error())
 		}
+		db.backClients = append(db.backClients, db.byName[client.Client_name])
+	}
+
+	if err := db.addRules(clients.Groups, clients.Rule); err != nil {
+		return nil, fmt.Errorf("Invalid clients file %s: %s", file, err.Error())
+	}
+	return db, nil
+}
+
+// addRules checks the groups and the rules against the clients
+func (db *clientsDB) addRules(groups map[string][]string, rules []ruleToml) error {
+	known := func(name string) bool {
+		_, ok := db.byName[name]
+		return ok
 	}
 
-	for _, client := range db.clients.To {
-		if client.Client_name == name {
-			return &clientInfo{
-				name: client.Client_name,
-				pubKey: client.Public_key,
-				front: false,
+	for group, members := range groups {
+		for _, member := range members {
+			if !known(member) {
+				return fmt.Errorf("Unknown client %s in group %s", member, group)
 			}
 		}
 	}
 
+	for i, rule := range rules {
+		parsed, err := parseACLRule(i+1, rule, groups, known)
+		if err != nil {
+			return err
+		}
+		db.rules = append(db.rules, parsed)
+	}
 	return nil
 }
 
-func (db clientsDB) ForwardAllowedFromTo(client1 ClientInfo, client2 ClientInfo) bool {
-	return client1.FrontClient() && !client2.FrontClient()
-}
+// add indexes the client. The names and the keys must be unique, as they identify the clients.
+func (db *clientsDB) add(client clientToml, front bool) error {
+	if client.Client_name == "" {
+		return fmt.Errorf("Client with no name")
+	}
+	if _, ok := db.byName[client.Client_name]; ok {
+		return fmt.Errorf("Duplicate client name %s", client.Client_name)
+	}
 
-func ClientsDBFromToml(file string) (ClientsDB, error) {
-	var clients dbToml
-	_, err := toml.DecodeFile(file, &clients)
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(client.Public_key))
 	if err != nil {
-		return nil, fmt.Errorf("Can't parse file: %s", err.Error())
+		return fmt.Errorf("Cannot parse the public key of %s: %s", client.Client_name,
+			err.Error())
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if other, ok := db.byFingerprint[fingerprint]; ok {
+		return fmt.Errorf("Clients %s and %s have the same public key", other.name,
+			client.Client_name)
+	}
 
+	info := &clientInfo{
+		name:   client.Client_name,
+		pubKey: encodeSSHPubKey(key),
+		front:  front,
 	}
-	return &clientsDB{
-		clients: clients,
-	}, nil
+	db.byName[info.name] = info
+	db.byFingerprint[fingerprint] = info
+	db.clients = append(db.clients, info)
+	return nil
 }
@@ -0,0 +1,86 @@
+package dryred
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readPubKey(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Can't read %s: %s", file, err.Error())
+	}
+	fields := strings.Fields(string(data))
+	return fields[0] + " " + fields[1]
+}
+
+func writeClientsToml(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "clients.toml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Can't write %s: %s", file, err.Error())
+	}
+	return file
+}
+
+func TestClientsDBFindClient(t *testing.T) {
+	clientsDB, err := ClientsDBFromToml("testdata/clients.toml")
+	if err != nil {
+		t.Fatal("Cant read the clients.toml file: ", err)
+	}
+
+	frontKey := readPubKey(t, "testdata/front_id_rsa.pub")
+	client := clientsDB.FindClientByPubKey(frontKey)
+	if client == nil || client.Name() != "elisescu" || !client.FrontClient() ||
+		client.PubKey() != frontKey {
+		t.Fatalf("Unexpected client for the front key: %v", client)
+	}
+
+	// The comment doesn't matter
+	client = clientsDB.FindClientByPubKey(readPubKey(t, "testdata/back_id_rsa.pub") + " pi@home")
+	if client == nil || client.Name() != "pi" || client.FrontClient() {
+		t.Fatalf("Unexpected client for the back key: %v", client)
+	}
+
+	// A truncated key is not a prefix match anymore
+	if client = clientsDB.FindClientByPubKey(frontKey[:len(frontKey)-20]); client != nil {
+		t.Fatalf("A truncated key matched %s", client.Name())
+	}
+	if client = clientsDB.FindClientByPubKey("ssh-rsa"); client != nil {
+		t.Fatalf("A key type matched %s", client.Name())
+	}
+
+	if client = clientsDB.FindClientByName("raspberrypi_2"); client == nil || client.FrontClient() {
+		t.Fatalf("Unexpected client raspberrypi_2: %v", client)
+	}
+	if client = clientsDB.FindClientByName("nobody"); client != nil {
+		t.Fatalf("Found an unknown client: %s", client.Name())
+	}
+}
+
+func TestClientsDBRejectsDuplicates(t *testing.T) {
+	frontKey := readPubKey(t, "testdata/front_id_rsa.pub")
+	backKey := readPubKey(t, "testdata/back_id_rsa.pub")
+
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{fmt.Sprintf("[[from]]\nclient_name = \"a\"\npublic_key = \"%s\"\n"+
+			"[[to]]\nclient_name = \"a\"\npublic_key = \"%s\"\n", frontKey, backKey),
+			"Duplicate client name a"},
+		{fmt.Sprintf("[[from]]\nclient_name = \"a\"\npublic_key = \"%s\"\n"+
+			"[[to]]\nclient_name = \"b\"\npublic_key = \"%s comment\"\n", frontKey, frontKey),
+			"Clients a and b have the same public key"},
+		{fmt.Sprintf("[[to]]\nclient_name = \"b\"\npublic_key = \"%s\"\n", backKey[:30]),
+			"Cannot parse the public key of b"},
+	}
+	for _, test := range tests {
+		_, err := ClientsDBFromToml(writeClientsToml(t, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Expected %q, got: %v", test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DRDialer dials the back clients through the server, like a net.Dialer, so it can be used as
+// http.Transport.DialContext, or as the dialer of database drivers and gRPC. All the dials share
+// a single connection to the server, opened on first use and again once it's lost.
+type DRDialer interface {
+	// DialContext dials a service.device name, e.g. router.po:80, or a device port, e.g.
+	// po:22, which is localhost:22 on the device. The services not in the config are resolved
+	// by the device, from the services it advertises, and the dialed port is ignored.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	Dial(network, address string) (net.Conn, error)
+	// Close the connection to the server, and all the dialed connections. The dials after it
+	// fail with net.ErrClosed.
+	Close() error
+}
+
+// DRDialerConfig describes the server to dial through, and the services of the back clients
+type DRDialerConfig struct {
+	Client        DRClient
+	ServerAddress string
+	// Services maps the service.device names to their address on the device, e.g. router.po to
+	// 192.168.0.1. Without a port, the dialed port is used. Can be nil.
+	Services map[string]string
+}
+
+type sshDRDialer struct {
+	config     DRDialerConfig
+	serverConn DRServerConn
+	// The dial of the shared connection in progress, if any
+	dialing *serverDial
+	closed  bool
+	lock    sync.Mutex
+}
+
+// serverDial is a dial of the shared connection, which the concurrent dials wait for
+type serverDial struct {
+	ctx        context.Context
+	done       chan struct{}
+	serverConn DRServerConn
+	err        error
+}
+
+func DRDialerNew(config DRDialerConfig) DRDialer {
+	return &sshDRDialer{
+		config: config,
+	}
+}
+
+// resolve maps the dialed address to the back client and the address it connects to
+func (dialer *sshDRDialer) resolve(address string) (backClient, backAddress string, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot parse address %s: %s", address, err.Error())
+	}
+
+	if target, ok := dialer.config.Services[host]; ok {
+		parts := strings.SplitN(host, ".", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "", "", fmt.Errorf("Service %s has no device. Use service.device", host)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, port)
+		}
+		return parts[1], target, nil
+	}
+
+	// Otherwise the device resolves the service name from its catalog
+	if parts := strings.SplitN(host, ".", 2); len(parts) == 2 {
+		if parts[0] == "" || parts[1] == "" {
+			return "", "", fmt.Errorf("Cannot parse service %s. Use service.device", host)
+		}
+		return parts[1], parts[0], nil
+	}
+	return host, net.JoinHostPort("localhost", port), nil
+}
+
+// connection returns the shared connection to the server, opening it if needed. Only one dial
+// opens it, and the others wait for it without holding the lock, until their context ends.
+func (dialer *sshDRDialer) connection(ctx context.Context) (DRServerConn, error) {
+	for {
+		dialer.lock.Lock()
+		if dialer.closed {
+			dialer.lock.Unlock()
+			return nil, fmt.Errorf("Dialer closed: %w", net.ErrClosed)
+		}
+		if dialer.serverConn != nil {
+			dialer.lock.Unlock()
+			return dialer.serverConn, nil
+		}
+		dial := dialer.dialing
+		if dial == nil {
+			dial = &serverDial{ctx: ctx, done: make(chan struct{})}
+			dialer.dialing = dial
+			dialer.lock.Unlock()
+			return dialer.dial(dial)
+		}
+		dialer.lock.Unlock()
+
+		select {
+		case <-dial.done:
+		case <-ctx.Done():
+			return nil, contextError(ctx, dialer.config.ServerAddress)
+		}
+		if dial.err == nil {
+			return dial.serverConn, nil
+		}
+		if dial.ctx.Err() != nil && ctx.Err() == nil {
+			// Only the context of the other dial ended. Dial again with this one
+			continue
+		}
+		return nil, dial.err
+	}
+}
+
+// dial opens the shared connection, and wakes up the dials waiting for it
+func (dialer *sshDRDialer) dial(dial *serverDial) (DRServerConn, error) {
+	serverConn, err := dialer.config.Client.DialServerContext(dial.ctx,
+		dialer.config.ServerAddress)
+
+	dialer.lock.Lock()
+	dialer.dialing = nil
+	closed := dialer.closed
+	if err == nil && !closed {
+		dialer.serverConn = serverConn
+	}
+	dialer.lock.Unlock()
+
+	if err == nil && closed {
+		// The dialer was closed while connecting
+		serverConn.Close()
+		serverConn, err = nil, fmt.Errorf("Dialer closed: %w", net.ErrClosed)
+	}
+
+	dial.serverConn, dial.err = serverConn, err
+	close(dial.done)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		serverConn.Wait()
+		dialer.forget(serverConn)
+	}()
+	return serverConn, nil
+}
+
+// forget the connection to the server, if still the shared one
+func (dialer *sshDRDialer) forget(serverConn DRServerConn) {
+	dialer.lock.Lock()
+	if dialer.serverConn == serverConn {
+		dialer.serverConn = nil
+	}
+	dialer.lock.Unlock()
+}
+
+func (dialer *sshDRDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Network %s is not supported", network)
+	}
+
+	backClient, backAddress, err := dialer.resolve(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for retry := 0; ; retry++ {
+		serverConn, err := dialer.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := serverConn.ConnectContext(ctx, backClient, backAddress)
+		if errors.Is(err, ErrConnectionFailed) && retry == 0 {
+			// The shared connection is dead. Try once again with a new one
+			dialer.forget(serverConn)
+			continue
+		}
+		return conn, err
+	}
+}
+
+func (dialer *sshDRDialer) Dial(network, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+func (dialer *sshDRDialer) Close() error {
+	dialer.lock.Lock()
+	dialer.closed = true
+	serverConn := dialer.serverConn
+	dialer.serverConn = nil
+	dialer.lock.Unlock()
+
+	if serverConn == nil {
+		return nil
+	}
+	return serverConn.Close()
+}
@@ -0,0 +1,193 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDRDialer(t *testing.T) {
+	const serverAddress string = "localhost:7017"
+	const webAddress string = "localhost:7018"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	listener, err := net.Listen("tcp", webAddress)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", webAddress, err.Error())
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer listener.Close()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{webAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	dialer := DRDialerNew(DRDialerConfig{
+		Client:        testClient(t, "testdata/front_id_rsa", "elisescu"),
+		ServerAddress: serverAddress,
+		Services: map[string]string{
+			"web.pi": "localhost",
+		},
+	})
+	defer dialer.Close()
+
+	httpClient := http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+	for _, url := range []string{"http://web.pi:7018/one", "http://pi:7018/two"} {
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			t.Fatalf("Can't get %s: %s", url, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello "+url[len(url)-4:] {
+			t.Fatalf("Got %q from %s", body, url)
+		}
+	}
+
+	// Both dials share the same connection to the server
+	conn1, err := dialer.Dial("tcp", "pi:7018")
+	if err != nil {
+		t.Fatalf("Can't dial: %s", err.Error())
+	}
+	defer conn1.Close()
+	conn2, err := dialer.Dial("tcp", "web.pi:7018")
+	if err != nil {
+		t.Fatalf("Can't dial: %s", err.Error())
+	}
+	defer conn2.Close()
+	if conn1.LocalAddr().String() != conn2.LocalAddr().String() {
+		t.Fatalf("Dials use different connections to the server: %s and %s",
+			conn1.LocalAddr(), conn2.LocalAddr())
+	}
+
+	if _, err = dialer.Dial("tcp", "db.pi:5432"); err == nil {
+		t.Fatalf("Dialed an unknown service")
+	}
+	if _, err = dialer.Dial("udp", "pi:53"); err == nil {
+		t.Fatalf("Dialed an unsupported network")
+	}
+}
+
+func TestDRDialerWaitsForTheDialWithItsContext(t *testing.T) {
+	const serverAddress string = "localhost:7040"
+
+	// The server accepts the connections, but never answers the SSH handshake
+	listener, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", serverAddress, err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialer := DRDialerNew(DRDialerConfig{
+		Client:        testClient(t, "testdata/front_id_rsa", "elisescu"),
+		ServerAddress: serverAddress,
+	})
+	defer dialer.Close()
+
+	slowCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := dialer.DialContext(slowCtx, "tcp", "pi:22")
+		slowErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The second dial waits for the first one to connect, but only until its own deadline
+	ctx, cancelFast := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelFast()
+	start := time.Now()
+	_, err = dialer.DialContext(ctx, "tcp", "pi:22")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected the second dial to time out, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("The second dial waited for the first one: %s", time.Since(start))
+	}
+
+	cancel()
+	if err = <-slowErr; !errors.Is(err, ErrCanceled) {
+		t.Fatalf("Expected the first dial to be canceled, got: %v", err)
+	}
+}
+
+func TestDRDialerClosedWhileConnecting(t *testing.T) {
+	const serverAddress string = "localhost:7044"
+	const slowAddress string = "localhost:7045"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	// The connections to the server are slow to start
+	listener, err := net.Listen("tcp", slowAddress)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", slowAddress, err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			time.Sleep(300 * time.Millisecond)
+			serverConn, err := net.Dial("tcp", serverAddress)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go forwardConnections(conn, serverConn)
+		}
+	}()
+
+	dialer := DRDialerNew(DRDialerConfig{
+		Client:        testClient(t, "testdata/front_id_rsa", "elisescu"),
+		ServerAddress: slowAddress,
+	})
+
+	dialErr := make(chan error, 1)
+	go func() {
+		_, err := dialer.Dial("tcp", "pi:22")
+		dialErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	dialer.Close()
+
+	if err = <-dialErr; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected the dial to fail with the dialer closed, got: %v", err)
+	}
+	sshDialer := dialer.(*sshDRDialer)
+	sshDialer.lock.Lock()
+	serverConn := sshDialer.serverConn
+	sshDialer.lock.Unlock()
+	if serverConn != nil {
+		t.Fatalf("The dialer kept the connection opened after it was closed")
+	}
+
+	if _, err = dialer.Dial("tcp", "pi:22"); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected the closed dialer to refuse dialing, got: %v", err)
+	}
+}
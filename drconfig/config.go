@@ -0,0 +1,431 @@
+// Package drconfig reads and writes the dr_config file, describing the devices (back clients) and
+// their services, used by both the front and the back side of dr:
+//
+//	# dr_config
+//	[po]
+//	auth_token=fba889c0ffee..5bcdf88d
+//
+//	[po.ssh]
+//	forwarder=tcp:8000:localhost:22
+//
+//	[po.router]
+//	destination_address=tcp:192.168.0.1:80
+//
+// A [device] section describes a device, and a [device.service] section one of its services. On
+// the front side, a forwarder listens on a local port and forwards to an address reachable by the
+// device. On the back side, the destination address is where the device forwards the sessions.
+package drconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	keyAuthToken          = "auth_token"
+	keyForwarder          = "forwarder"
+	keyDestinationAddress = "destination_address"
+)
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Config is the content of a dr_config file. Hosts and services keep the file order.
+type Config struct {
+	Hosts []*Host
+}
+
+// Host is a [device] section
+type Host struct {
+	Name      string
+	AuthToken string
+	Services  []*Service
+}
+
+// Service is a [device.service] section
+type Service struct {
+	Name               string
+	Forwarder          *Forwarder
+	DestinationAddress *Address
+}
+
+// Forwarder is a local port forwarded to an address reachable by the device:
+// network:localport:host:port
+type Forwarder struct {
+	Network       string
+	LocalPort     int
+	RemoteAddress string
+}
+
+// Address is a network address: network:host:port
+type Address struct {
+	Network string
+	Address string
+}
+
+// Load reads and validates a dr_config file
+func Load(fileName string) (*Config, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+	return config, nil
+}
+
+// Parse reads and validates a dr_config
+func Parse(reader io.Reader) (*Config, error) {
+	config := &Config{}
+	var host *Host
+	var service *Service
+
+	scanner := bufio.NewScanner(reader)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section %q", lineNum, line)
+			}
+
+			hostName, serviceName, err := SplitName(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err.Error())
+			}
+
+			host, service = config.Host(hostName), nil
+			if serviceName == "" {
+				if host != nil {
+					return nil, fmt.Errorf("line %d: duplicate section [%s]", lineNum,
+						hostName)
+				}
+				host = config.AddHost(hostName)
+				continue
+			}
+
+			if host == nil {
+				host = config.AddHost(hostName)
+			}
+			if host.Service(serviceName) != nil {
+				return nil, fmt.Errorf("line %d: duplicate section [%s.%s]", lineNum,
+					hostName, serviceName)
+			}
+			service = host.AddService(serviceName)
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNum, line)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		if host == nil {
+			return nil, fmt.Errorf("line %d: %s outside of any section", lineNum, key)
+		}
+
+		if err := setValue(host, service, key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return config, config.Validate()
+}
+
+func setValue(host *Host, service *Service, key, value string) (err error) {
+	if service == nil {
+		switch key {
+		case keyAuthToken:
+			host.AuthToken = value
+		default:
+			return fmt.Errorf("unknown key %s in [%s]", key, host.Name)
+		}
+		return nil
+	}
+
+	switch key {
+	case keyForwarder:
+		service.Forwarder, err = ParseForwarder(value)
+	case keyDestinationAddress:
+		service.DestinationAddress, err = ParseAddress(value)
+	default:
+		return fmt.Errorf("unknown key %s in [%s.%s]", key, host.Name, service.Name)
+	}
+	return err
+}
+
+// Validate checks the names, addresses and that no two forwarders use the same local port
+func (config *Config) Validate() error {
+	ports := make(map[int]string)
+
+	for _, host := range config.Hosts {
+		if !nameRegexp.MatchString(host.Name) {
+			return fmt.Errorf("invalid device name %q", host.Name)
+		}
+
+		for _, service := range host.Services {
+			fullName := host.Name + "." + service.Name
+
+			if !nameRegexp.MatchString(service.Name) {
+				return fmt.Errorf("invalid service name %q", fullName)
+			}
+
+			if service.Forwarder == nil && service.DestinationAddress == nil {
+				return fmt.Errorf("[%s] has no %s or %s", fullName, keyForwarder,
+					keyDestinationAddress)
+			}
+
+			if service.Forwarder != nil {
+				if err := service.Forwarder.validate(); err != nil {
+					return fmt.Errorf("[%s] %s", fullName, err.Error())
+				}
+				port := service.Forwarder.LocalPort
+				if other, ok := ports[port]; ok {
+					return fmt.Errorf("[%s] local port %d already used by [%s]", fullName,
+						port, other)
+				}
+				ports[port] = fullName
+			}
+
+			if service.DestinationAddress != nil {
+				if err := service.DestinationAddress.validate(); err != nil {
+					return fmt.Errorf("[%s] %s", fullName, err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Write the config in the dr_config format
+func (config *Config) Write(writer io.Writer) error {
+	buffer := bufio.NewWriter(writer)
+
+	for i, host := range config.Hosts {
+		if i > 0 {
+			fmt.Fprintln(buffer)
+		}
+		fmt.Fprintf(buffer, "[%s]\n", host.Name)
+		if host.AuthToken != "" {
+			fmt.Fprintf(buffer, "%s=%s\n", keyAuthToken, host.AuthToken)
+		}
+
+		for _, service := range host.Services {
+			fmt.Fprintf(buffer, "\n[%s.%s]\n", host.Name, service.Name)
+			if service.Forwarder != nil {
+				fmt.Fprintf(buffer, "%s=%s\n", keyForwarder, service.Forwarder.String())
+			}
+			if service.DestinationAddress != nil {
+				fmt.Fprintf(buffer, "%s=%s\n", keyDestinationAddress,
+					service.DestinationAddress.String())
+			}
+		}
+	}
+
+	return buffer.Flush()
+}
+
+// Save validates and writes the config to a file, creating its directory if needed
+func (config *Config) Save(fileName string) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a failure doesn't leave a truncated config behind
+	file, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err = config.Write(file); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Host returns the named host, or nil
+func (config *Config) Host(name string) *Host {
+	for _, host := range config.Hosts {
+		if host.Name == name {
+			return host
+		}
+	}
+	return nil
+}
+
+// AddHost adds a new host section, or returns the existing one
+func (config *Config) AddHost(name string) *Host {
+	if host := config.Host(name); host != nil {
+		return host
+	}
+	host := &Host{Name: name}
+	config.Hosts = append(config.Hosts, host)
+	return host
+}
+
+// Lookup returns the host and the service of a "device.service" name, or nil if not found
+func (config *Config) Lookup(name string) (*Host, *Service) {
+	hostName, serviceName, err := SplitName(name)
+	if err != nil || serviceName == "" {
+		return nil, nil
+	}
+
+	host := config.Host(hostName)
+	if host == nil {
+		return nil, nil
+	}
+	service := host.Service(serviceName)
+	if service == nil {
+		return nil, nil
+	}
+	return host, service
+}
+
+// Service returns the named service of the host, or nil
+func (host *Host) Service(name string) *Service {
+	for _, service := range host.Services {
+		if service.Name == name {
+			return service
+		}
+	}
+	return nil
+}
+
+// AddService adds a new service section, or returns the existing one
+func (host *Host) AddService(name string) *Service {
+	if service := host.Service(name); service != nil {
+		return service
+	}
+	service := &Service{Name: name}
+	host.Services = append(host.Services, service)
+	return service
+}
+
+// SplitName splits a "device" or "device.service" name
+func SplitName(name string) (host, service string, err error) {
+	parts := strings.Split(strings.TrimSpace(name), ".")
+	if len(parts) > 2 {
+		return "", "", fmt.Errorf("invalid name %q: expected device or device.service", name)
+	}
+
+	for _, part := range parts {
+		if !nameRegexp.MatchString(part) {
+			return "", "", fmt.Errorf("invalid name %q", name)
+		}
+	}
+
+	if len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+	return parts[0], "", nil
+}
+
+// ParseForwarder parses network:localport:host:port, e.g. tcp:8000:localhost:22
+func ParseForwarder(value string) (*Forwarder, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid forwarder %q: expected tcp:localport:host:port", value)
+	}
+
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarder %q: bad local port", value)
+	}
+
+	forwarder := &Forwarder{
+		Network:       parts[0],
+		LocalPort:     port,
+		RemoteAddress: parts[2],
+	}
+	if err = forwarder.validate(); err != nil {
+		return nil, err
+	}
+	return forwarder, nil
+}
+
+// ParseAddress parses network:host:port, e.g. tcp:192.168.0.1:80
+func ParseAddress(value string) (*Address, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid address %q: expected tcp:host:port", value)
+	}
+
+	address := &Address{
+		Network: parts[0],
+		Address: parts[1],
+	}
+	if err := address.validate(); err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+func (forwarder *Forwarder) validate() error {
+	if forwarder.Network != "tcp" {
+		return fmt.Errorf("unsupported network %q", forwarder.Network)
+	}
+	if forwarder.LocalPort <= 0 || forwarder.LocalPort > 65535 {
+		return fmt.Errorf("invalid local port %d", forwarder.LocalPort)
+	}
+	return validateHostPort(forwarder.RemoteAddress)
+}
+
+func (forwarder *Forwarder) String() string {
+	return fmt.Sprintf("%s:%d:%s", forwarder.Network, forwarder.LocalPort,
+		forwarder.RemoteAddress)
+}
+
+func (address *Address) validate() error {
+	if address.Network != "tcp" {
+		return fmt.Errorf("unsupported network %q", address.Network)
+	}
+	return validateHostPort(address.Address)
+}
+
+func (address *Address) String() string {
+	return address.Network + ":" + address.Address
+}
+
+func validateHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	if portNum, err := strconv.Atoi(port); err != nil || portNum <= 0 || portNum > 65535 {
+		return fmt.Errorf("invalid port in address %q", address)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package drconfig
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const brainstormConfig = `# dr_config
+[po]
+auth_token=fba889c0ffee..5bcdf88d
+
+[po.ssh]
+forwarder=tcp:8000:localhost:22
+
+[po.router]
+destination_address=tcp:192.168.0.1:80
+`
+
+func TestParseAndWrite(t *testing.T) {
+	config, err := Parse(strings.NewReader(brainstormConfig))
+	if err != nil {
+		t.Fatalf("Can't parse config: %s", err.Error())
+	}
+
+	host, service := config.Lookup("po.ssh")
+	if host == nil || service == nil {
+		t.Fatal("po.ssh not found")
+	}
+	if host.AuthToken != "fba889c0ffee..5bcdf88d" {
+		t.Fatalf("Wrong auth token %q", host.AuthToken)
+	}
+	if service.Forwarder.LocalPort != 8000 || service.Forwarder.RemoteAddress != "localhost:22" {
+		t.Fatalf("Wrong forwarder %s", service.Forwarder.String())
+	}
+
+	_, service = config.Lookup("po.router")
+	if service == nil || service.DestinationAddress.Address != "192.168.0.1:80" {
+		t.Fatal("Wrong po.router destination address")
+	}
+
+	var buffer bytes.Buffer
+	if err = config.Write(&buffer); err != nil {
+		t.Fatalf("Can't write config: %s", err.Error())
+	}
+	if buffer.String() != strings.TrimPrefix(brainstormConfig, "# dr_config\n") {
+		t.Fatalf("Written config differs:\n%s", buffer.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := map[string]string{
+		"outside section":   "auth_token=abc\n",
+		"unknown key":       "[po]\nfoo=bar\n",
+		"duplicate section": "[po]\n[po]\n",
+		"bad name":          "[po.ssh.x]\n",
+		"bad forwarder":     "[po.ssh]\nforwarder=tcp:80:localhost\n",
+		"bad network":       "[po.ssh]\nforwarder=udp:8000:localhost:22\n",
+		"no address":        "[po.ssh]\n",
+		"port reused":       "[po.ssh]\nforwarder=tcp:8000:localhost:22\n[pi.ssh]\nforwarder=tcp:8000:localhost:22\n",
+	}
+
+	for name, content := range invalid {
+		if _, err := Parse(strings.NewReader(content)); err == nil {
+			t.Errorf("Parsed invalid config: %s", name)
+		}
+	}
+}
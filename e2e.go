@@ -0,0 +1,103 @@
+package dryred
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"time"
+)
+
+// The end-to-end session is a nested SSH connection, run over a forwarded session between the
+// front client (the SSH client) and the back client (the SSH server). Both sides authenticate with
+// the same keys they use with the server, and check the peer key against their PeersDB.
+
+const endToEndHandshakeTimeout = 10 * time.Second
+
+// endToEndClientConn runs the front client side of the end-to-end handshake over conn, and
+// returns the connection to the back client. conn is closed if the handshake fails.
+func endToEndClientConn(client *sshDRClient, conn net.Conn, backClient string) (net.Conn, error) {
+	config := ssh.ClientConfig{
+		User: client.config.User,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(client.signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			peer := client.config.PeersDB.FindClientByPubKey(encodeSSHPubKey(key))
+			if peer == nil || peer.FrontClient() || peer.Name() != backClient {
+				return fmt.Errorf("Back client %s presented an unknown key %s", backClient,
+					ssh.FingerprintSHA256(key))
+			}
+			return nil
+		},
+	}
+
+	// The channel conn has no deadlines, so close it if the handshake takes too long
+	timer := time.AfterFunc(endToEndHandshakeTimeout, func() { conn.Close() })
+	sshConn, sshChans, sshReqs, err := ssh.NewClientConn(conn, backClient, &config)
+	timer.Stop()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("End-to-end handshake with %s failed: %s", backClient,
+			err.Error())
+	}
+	go discardSSHChans(sshChans)
+	go discardSSHRequests(sshReqs)
+
+	channel, reqs, err := sshConn.OpenChannel(FWEndToEndChannelName, nil)
+	if err != nil {
+		sshConn.Close()
+		return nil, fmt.Errorf("Cannot open the end-to-end session with %s: %s", backClient,
+			err.Error())
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return sshChannelConnNew(channel, conn.LocalAddr(), conn.RemoteAddr(), sshConn.Close), nil
+}
+
+// endToEndServerConn runs the back client side of the end-to-end handshake over conn, and
+// returns the connection to the front client. conn is closed if the handshake fails.
+func endToEndServerConn(client *sshDRClient, conn net.Conn) (net.Conn, error) {
+	config := ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			peer := client.config.PeersDB.FindClientByPubKey(encodeSSHPubKey(pubKey))
+			if peer == nil || !peer.FrontClient() || peer.Name() != c.User() {
+				return nil, fmt.Errorf("Unknown front client key for %q", c.User())
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"client-name": peer.Name(),
+				},
+			}, nil
+		},
+	}
+	config.AddHostKey(client.signer)
+
+	timer := time.AfterFunc(endToEndHandshakeTimeout, func() { conn.Close() })
+	sshConn, sshChans, sshReqs, err := ssh.NewServerConn(conn, &config)
+	timer.Stop()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("End-to-end handshake failed: %s", err.Error())
+	}
+	go discardSSHRequests(sshReqs)
+
+	for newChannel := range sshChans {
+		if newChannel.ChannelType() != FWEndToEndChannelName {
+			newChannel.Reject(ssh.UnknownChannelType, "Unknown channel type")
+			continue
+		}
+
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			break
+		}
+		go ssh.DiscardRequests(reqs)
+		// Only one session per end-to-end connection
+		go discardSSHChans(sshChans)
+
+		return sshChannelConnNew(channel, conn.LocalAddr(), conn.RemoteAddr(),
+			sshConn.Close), nil
+	}
+
+	sshConn.Close()
+	return nil, fmt.Errorf("End-to-end session with %s closed before opening a channel",
+		sshConn.Permissions.Extensions["client-name"])
+}
@@ -0,0 +1,69 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDRClientErrorCodes(t *testing.T) {
+	const serverAddress string = "localhost:7030"
+	// Nothing listens on it
+	const deadAddress string = "localhost:7029"
+	const targetAddress string = "localhost:7031"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{deadAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	ctx := context.Background()
+
+	tests := []struct {
+		backClient string
+		address    string
+		expected   error
+		kind       error
+		retryable  bool
+	}{
+		{"pi", deadAddress, ErrDialFailed, ErrDialFailed, true},
+		{"pi", targetAddress, ErrForbiddenTarget, ErrForbidden, false},
+		{"nobody", targetAddress, ErrUnauthorized, ErrForbidden, false},
+		{"raspberrypi_2", targetAddress, ErrBackClientOffline, ErrBackClientOffline, true},
+	}
+	for _, test := range tests {
+		_, err := frontClient.ConnectContext(ctx, serverAddress, test.backClient, test.address)
+		if !errors.Is(err, test.expected) || !errors.Is(err, test.kind) {
+			t.Fatalf("Expected %s to %s to fail with %q, got: %v", test.backClient,
+				test.address, test.expected, err)
+		}
+		var drErr *DRClientError
+		if !errors.As(err, &drErr) || drErr.Temporary() != test.retryable {
+			t.Fatalf("Unexpected retry hint for %s to %s: %v", test.backClient,
+				test.address, err)
+		}
+	}
+
+	if _, err := backClient.ListBackClients(ctx, serverAddress); !errors.Is(err, ErrNotFrontClient) {
+		t.Fatalf("Expected the back client not to list, got: %v", err)
+	}
+	if _, err := frontClient.Listen(serverAddress); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected the front client not to listen, got: %v", err)
+	}
+
+	serverConn, err := frontClient.DialServerContext(ctx, serverAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the server: %s", err.Error())
+	}
+	defer serverConn.Close()
+
+	server.Stop()
+	_, err = serverConn.ConnectContext(ctx, "pi", deadAddress)
+	if !errors.Is(err, ErrServerShuttingDown) {
+		t.Fatalf("Expected the server to be shutting down, got: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"sync"
+)
+
+// The kinds of DRClientError. Use them with errors.Is, e.g. errors.Is(err, ErrBackClientOffline)
+var (
+	ErrConnectionFailed  = errors.New("Connection to the server failed")
+	ErrServerKeyRejected = errors.New("Server key rejected")
+	ErrAuthFailed        = errors.New("Authentication failed")
+	ErrBackClientOffline = errors.New("Back client is offline")
+	ErrForbidden         = errors.New("Forwarding is not allowed")
+	ErrEndToEndFailed    = errors.New("End-to-end session failed")
+	ErrVersionMismatch   = errors.New("No common protocol version")
+	ErrTimeout           = errors.New("Timeout")
+	ErrCanceled          = errors.New("Canceled")
+)
+
+// The errors of the FWErrorCode sent by the server. They narrow down the kinds above, e.g. an
+// error that is ErrForbiddenTarget is also ErrForbidden.
+var (
+	ErrUnauthorized       = errors.New("Unauthorized")
+	ErrNotFrontClient     = errors.New("Not a front client")
+	ErrForbiddenTarget    = errors.New("Target is not allowed")
+	ErrDialFailed         = errors.New("Back client cannot connect to the target")
+	ErrQuotaExceeded      = errors.New("Quota exceeded")
+	ErrServerShuttingDown = errors.New("Server is shutting down")
+	ErrBadRequest         = errors.New("Malformed request")
+)
+
+// errorCodes maps every FWErrorCode to its kind and its error
+var errorCodes = map[FWErrorCode]struct{ kind, err error }{
+	FWErrUnauthorized:       {ErrForbidden, ErrUnauthorized},
+	FWErrNotAFrontClient:    {ErrForbidden, ErrNotFrontClient},
+	FWErrBackClientOffline:  {ErrBackClientOffline, ErrBackClientOffline},
+	FWErrForbiddenTarget:    {ErrForbidden, ErrForbiddenTarget},
+	FWErrDialFailed:         {ErrDialFailed, ErrDialFailed},
+	FWErrQuotaExceeded:      {ErrQuotaExceeded, ErrQuotaExceeded},
+	FWErrServerShuttingDown: {ErrServerShuttingDown, ErrServerShuttingDown},
+	FWErrBadRequest:         {ErrBadRequest, ErrBadRequest},
+}
+
+// DRClientError is returned by the DRClient calls. Kind is one of the Err* errors above, and Err
+// is the cause. Code is set when the server sent one, and Retryable is its hint.
+type DRClientError struct {
+	Kind      error
+	Err       error
+	Code      FWErrorCode
+	Retryable bool
+}
+
+func (err *DRClientError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *DRClientError) Unwrap() error {
+	return err.Err
+}
+
+func (err *DRClientError) Is(target error) bool {
+	if target == err.Kind {
+		return true
+	}
+	codeErrors, ok := errorCodes[err.Code]
+	return ok && target == codeErrors.err
+}
+
+// Timeout makes DRClientError a net.Error, like the errors of the net package dialers
+func (err *DRClientError) Timeout() bool {
+	return err.Kind == ErrTimeout
+}
+
+func (err *DRClientError) Temporary() bool {
+	return err.Retryable || err.Kind == ErrTimeout || err.Kind == ErrBackClientOffline
+}
+
+func clientError(kind error, format string, args ...interface{}) error {
+	return &DRClientError{
+		Kind: kind,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// handshakeError classifies the error of the SSH handshake with the server
+func handshakeError(serverAddress string, err error) error {
+	var hostKeyErr *HostKeyError
+	if errors.As(err, &hostKeyErr) {
+		return clientError(ErrServerKeyRejected, "Cannot perform SSH connection %w", err)
+	}
+	// The ssh package has no typed error for it
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return clientError(ErrAuthFailed, "Server %s refused the key: %w", serverAddress, err)
+	}
+	return clientError(ErrConnectionFailed, "Cannot perform SSH connection %w", err)
+}
+
+// rejectionKind classifies the refusal of a forwarded session by the server, from its reason
+func rejectionKind(openErr *ssh.OpenChannelError) error {
+	switch openErr.Reason {
+	case ssh.ConnectionFailed:
+		return ErrBackClientOffline
+	case ssh.Prohibited:
+		return ErrForbidden
+	}
+	return ErrConnectionFailed
+}
+
+func rejectionError(openErr *ssh.OpenChannelError, format string, args ...interface{}) error {
+	return clientError(rejectionKind(openErr), format, args...)
+}
+
+// codeError is the error of a request refused with an error code. The codes unknown to this
+// client, sent by newer servers, get the fallback kind.
+func codeError(code FWErrorCode, retryable bool, fallback error, format string, args ...interface{}) error {
+	kind := fallback
+	if codeErrors, ok := errorCodes[code]; ok {
+		kind = codeErrors.kind
+	}
+	return &DRClientError{
+		Kind:      kind,
+		Err:       fmt.Errorf(format, args...),
+		Code:      code,
+		Retryable: retryable,
+	}
+}
+
+// contextError is the error returned when the context ended the call
+func contextError(ctx context.Context, serverAddress string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return clientError(ErrTimeout, "Timeout talking to %s: %w", serverAddress, ctx.Err())
+	}
+	return clientError(ErrCanceled, "Canceled talking to %s: %w", serverAddress, ctx.Err())
+}
+
+// contextWatch closes a connection as soon as its context is done, so that all the blocked SSH
+// calls on it return
+type contextWatch struct {
+	stop     chan struct{}
+	done     chan bool
+	once     sync.Once
+	canceled bool
+}
+
+func watchContext(ctx context.Context, conn net.Conn) *contextWatch {
+	watch := &contextWatch{
+		stop: make(chan struct{}),
+		done: make(chan bool, 1),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			watch.done <- true
+		case <-watch.stop:
+			watch.done <- false
+		}
+	}()
+	return watch
+}
+
+// Stop ends the watch, and tells if the context closed the connection
+func (watch *contextWatch) Stop() bool {
+	watch.once.Do(func() {
+		close(watch.stop)
+		watch.canceled = <-watch.done
+	})
+	return watch.canceled
+}
@@ -0,0 +1,139 @@
+package dryred
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// DRForwarder forwards the connections accepted on a local address to a back client, via the
+// server. It is the front client side of a forward route, e.g. tcp:8000:localhost:22.
+type DRForwarder interface {
+	ListenAndServe(address string) error
+	// Serve the connections accepted on an already open listener
+	Serve(listener net.Listener) error
+	// Stop the forwarder, and close all the forwarded connections
+	Stop() error
+}
+
+// DRForwarderConfig describes where the forwarded connections go
+type DRForwarderConfig struct {
+	Client                DRClient
+	ServerAddress         string
+	BackClientName        string
+	BackConnectionAddress string
+}
+
+type localDRForwarder struct {
+	config   DRForwarderConfig
+	listener net.Listener
+	stopped  bool
+	conns    map[net.Conn]bool
+	lock     sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func DRForwarderNew(config DRForwarderConfig) DRForwarder {
+	return &localDRForwarder{
+		config: config,
+		conns:  make(map[net.Conn]bool),
+	}
+}
+
+func (forwarder *localDRForwarder) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s: %s", address, err.Error())
+	}
+
+	return forwarder.Serve(listener)
+}
+
+func (forwarder *localDRForwarder) Serve(listener net.Listener) error {
+	forwarder.lock.Lock()
+	if forwarder.stopped {
+		forwarder.lock.Unlock()
+		listener.Close()
+		return fmt.Errorf("Forwarder stopped")
+	}
+	forwarder.listener = listener
+	forwarder.lock.Unlock()
+
+	log.Printf("Forwarding %s to %s on %s", listener.Addr().String(),
+		forwarder.config.BackConnectionAddress, forwarder.config.BackClientName)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			// The forwarder was stopped
+			forwarder.wg.Wait()
+			return err
+		}
+
+		if !forwarder.track(conn, true) {
+			conn.Close()
+			continue
+		}
+		forwarder.wg.Add(1)
+		go forwarder.forward(conn)
+	}
+}
+
+func (forwarder *localDRForwarder) forward(localConn net.Conn) {
+	defer forwarder.wg.Done()
+	defer forwarder.track(localConn, false)
+
+	remoteConn, err := forwarder.config.Client.Connect(forwarder.config.ServerAddress,
+		forwarder.config.BackClientName, forwarder.config.BackConnectionAddress)
+
+	if err != nil {
+		log.Printf("Cannot forward connection from %s: %s",
+			localConn.RemoteAddr().String(), err.Error())
+		localConn.Close()
+		return
+	}
+
+	if !forwarder.track(remoteConn, true) {
+		localConn.Close()
+		remoteConn.Close()
+		return
+	}
+	defer forwarder.track(remoteConn, false)
+
+	forwardConnections(localConn, remoteConn)
+}
+
+// track adds or removes a connection from the ones closed on Stop. It returns false if the
+// forwarder is already stopped.
+func (forwarder *localDRForwarder) track(conn net.Conn, add bool) bool {
+	forwarder.lock.Lock()
+	defer forwarder.lock.Unlock()
+
+	if add {
+		if forwarder.stopped {
+			return false
+		}
+		forwarder.conns[conn] = true
+	} else {
+		delete(forwarder.conns, conn)
+	}
+	return true
+}
+
+func (forwarder *localDRForwarder) Stop() error {
+	forwarder.lock.Lock()
+	defer forwarder.lock.Unlock()
+
+	forwarder.stopped = true
+	for conn := range forwarder.conns {
+		conn.Close()
+	}
+
+	if forwarder.listener != nil {
+		return forwarder.listener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package dryred
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+)
+
+// localCapabilities are the capabilities of this implementation, of the clients and the server
+var localCapabilities = []string{FWCapMultiplexing, FWCapEndToEnd, FWCapServices, FWCapList}
+
+// legacyHello is the agreement with the peers older than the hello request
+var legacyHello = FWHelloReply_V1{
+	Status:       true,
+	Version:      1,
+	Capabilities: []string{FWCapMultiplexing, FWCapEndToEnd},
+}
+
+func helloRequest() FWHelloRequest_V1 {
+	return FWHelloRequest_V1{
+		MinVersion:   FWMinProtocolVersion,
+		MaxVersion:   FWProtocolVersion,
+		Capabilities: localCapabilities,
+	}
+}
+
+// negotiateHello picks the newest protocol version, and the capabilities, both sides have
+func negotiateHello(request FWHelloRequest_V1) FWHelloReply_V1 {
+	version := FWProtocolVersion
+	if request.MaxVersion < version {
+		version = request.MaxVersion
+	}
+	if version < FWMinProtocolVersion || version < request.MinVersion {
+		return FWHelloReply_V1{
+			Status: false,
+			ErrorMessage: fmt.Sprintf("No common protocol version: the client talks %d to %d, "+
+				"the server %d to %d", request.MinVersion, request.MaxVersion,
+				FWMinProtocolVersion, FWProtocolVersion),
+		}
+	}
+
+	capabilities := []string{}
+	for _, capability := range request.Capabilities {
+		if hasCapability(localCapabilities, capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	return FWHelloReply_V1{
+		Status:       true,
+		Version:      version,
+		Capabilities: capabilities,
+	}
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, name := range capabilities {
+		if name == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// sayHello agrees with the server on the protocol version and the capabilities. The servers
+// older than the hello request refuse it without a reply, and talk version 1.
+func sayHello(ctx context.Context, sshConn ssh.Conn, tcpConn net.Conn, serverAddress string) (FWHelloReply_V1, error) {
+	request, err := json.Marshal(helloRequest())
+	if err != nil {
+		panic(err)
+	}
+
+	watch := watchContext(ctx, tcpConn)
+	ok, data, err := sshConn.SendRequest(FWHelloRequestName, true, request)
+
+	if watch.Stop() {
+		return FWHelloReply_V1{}, contextError(ctx, serverAddress)
+	}
+	if err != nil {
+		return FWHelloReply_V1{}, clientError(ErrConnectionFailed,
+			"Cannot send hello request: %s", err.Error())
+	}
+
+	var reply FWHelloReply_V1
+	if err = json.Unmarshal(data, &reply); err != nil {
+		if !ok {
+			return legacyHello, nil
+		}
+		return FWHelloReply_V1{}, clientError(ErrConnectionFailed,
+			"Cannot parse hello reply: %s", err.Error())
+	}
+
+	if !ok || !reply.Status {
+		return FWHelloReply_V1{}, clientError(ErrVersionMismatch,
+			"Server %s refused the protocol: %s", serverAddress, reply.ErrorMessage)
+	}
+	if reply.Version < FWMinProtocolVersion || reply.Version > FWProtocolVersion {
+		return FWHelloReply_V1{}, clientError(ErrVersionMismatch,
+			"Server %s agreed on protocol version %d, but only %d to %d are supported",
+			serverAddress, reply.Version, FWMinProtocolVersion, FWProtocolVersion)
+	}
+	return reply, nil
+}
+
+// handleHello answers the hello request of a client. The clients with no protocol version in
+// common are disconnected.
+func (server *sshDRServer) handleHello(client ClientInfo, sshConn ssh.Conn, req *ssh.Request) {
+	var request FWHelloRequest_V1
+	reply := FWHelloReply_V1{
+		Status:       false,
+		ErrorMessage: "Cannot parse the hello request",
+	}
+	if err := json.Unmarshal(req.Payload, &request); err == nil {
+		reply = negotiateHello(request)
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	req.Reply(reply.Status, data)
+
+	if !reply.Status {
+		log.Printf("Disconnecting %s: %s", client.Name(), reply.ErrorMessage)
+		sshConn.Close()
+		return
+	}
+	log.Printf("Client %s talks protocol version %d, with %v", client.Name(), reply.Version,
+		reply.Capabilities)
+}
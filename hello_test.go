@@ -0,0 +1,101 @@
+package dryred
+
+import (
+	"context"
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateHello(t *testing.T) {
+	reply := negotiateHello(FWHelloRequest_V1{
+		MinVersion:   1,
+		MaxVersion:   5,
+		Capabilities: []string{FWCapList, "compression", FWCapMultiplexing},
+	})
+	if !reply.Status || reply.Version != FWProtocolVersion {
+		t.Fatalf("Expected version %d, got %+v", FWProtocolVersion, reply)
+	}
+	if len(reply.Capabilities) != 2 || reply.Capabilities[0] != FWCapList ||
+		reply.Capabilities[1] != FWCapMultiplexing {
+		t.Fatalf("Unexpected capabilities %v", reply.Capabilities)
+	}
+
+	reply = negotiateHello(FWHelloRequest_V1{MinVersion: 1, MaxVersion: 1})
+	if !reply.Status || reply.Version != 1 || len(reply.Capabilities) != 0 {
+		t.Fatalf("Expected version 1, got %+v", reply)
+	}
+
+	reply = negotiateHello(FWHelloRequest_V1{MinVersion: FWProtocolVersion + 1,
+		MaxVersion: FWProtocolVersion + 2})
+	if reply.Status || !strings.Contains(reply.ErrorMessage, "No common protocol version") {
+		t.Fatalf("Expected no common version, got %+v", reply)
+	}
+}
+
+// rawSSHClient connects to the server with the ssh package only, like the clients of other
+// protocol versions
+func rawSSHClient(t *testing.T, serverAddress, keyFile, user string) ssh.Conn {
+	signer, err := loadSSHPrivateKey(keyFile, sshKeyPassphrase{passphrase: "TestTest"})
+	if err != nil {
+		t.Fatalf("Can't load key: %s", err.Error())
+	}
+	client, err := ssh.Dial("tcp", serverAddress, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Can't connect to the server: %s", err.Error())
+	}
+	return client.Conn
+}
+
+func TestDRServerHello(t *testing.T) {
+	const serverAddress string = "localhost:7028"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	// A client from the future is refused with an explicit error
+	futureConn := rawSSHClient(t, serverAddress, "testdata/front_id_rsa", "elisescu")
+	request, _ := json.Marshal(FWHelloRequest_V1{MinVersion: 7, MaxVersion: 9})
+	ok, data, err := futureConn.SendRequest(FWHelloRequestName, true, request)
+	var reply FWHelloReply_V1
+	if err != nil || ok || json.Unmarshal(data, &reply) != nil || reply.Status ||
+		!strings.Contains(reply.ErrorMessage, "the server 1 to 2") {
+		t.Fatalf("Expected the hello to be refused, got %v, %q, %v", ok, data, err)
+	}
+	if err = futureConn.Wait(); err == nil {
+		t.Fatalf("The client from the future is still connected")
+	}
+
+	// A back client older than the hello request still registers
+	legacyConn := rawSSHClient(t, serverAddress, "testdata/back_id_rsa", "pi")
+	defer legacyConn.Close()
+	request, _ = json.Marshal(FWListenRequest_V1{Name: "pi"})
+	if ok, _, err = legacyConn.SendRequest(FWListenRequestName, true, request); !ok || err != nil {
+		t.Fatalf("The legacy back client can't register: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	backClients, err := frontClient.ListBackClients(context.Background(), serverAddress)
+	if err != nil || !backClients[0].Online {
+		t.Fatalf("The legacy back client is not online: %+v, %v", backClients, err)
+	}
+
+	// A malformed listen request is refused, and the client disconnected
+	badConn := rawSSHClient(t, serverAddress, "testdata/back_id_rsa", "pi")
+	ok, data, err = badConn.SendRequest(FWListenRequestName, true, []byte("{not json"))
+	var listenReply FWListenReply_V1
+	if err != nil || ok || json.Unmarshal(data, &listenReply) != nil || listenReply.Status ||
+		listenReply.ErrorCode != FWErrBadRequest {
+		t.Fatalf("Expected the listen to be refused, got %v, %q, %v", ok, data, err)
+	}
+	if err = badConn.Wait(); err == nil {
+		t.Fatalf("The client with the malformed listen is still connected")
+	}
+}
@@ -0,0 +1,185 @@
+package dryred
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// HostKeyPolicy tells how a client verifies the key of the server
+type HostKeyPolicy int
+
+const (
+	// HostKeyTOFU trusts the key of a server seen for the first time, and records it in the
+	// known hosts file. A different key for a known server is refused.
+	HostKeyTOFU HostKeyPolicy = iota
+	// HostKeyStrict only accepts the keys already in the known hosts file
+	HostKeyStrict
+	// HostKeyPinned only accepts the key with the configured fingerprint
+	HostKeyPinned
+)
+
+// ParseHostKeyPolicy parses the policy names: tofu, strict and pinned
+func ParseHostKeyPolicy(name string) (HostKeyPolicy, error) {
+	switch name {
+	case "tofu":
+		return HostKeyTOFU, nil
+	case "strict":
+		return HostKeyStrict, nil
+	case "pinned":
+		return HostKeyPinned, nil
+	}
+	return HostKeyTOFU, fmt.Errorf("Unknown host key policy %q", name)
+}
+
+// DefaultKnownHostsFile is used when DRClientSSHConfig.KnownHostsFile is not set
+func DefaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".dryred", "known_hosts")
+}
+
+// HostKeyError is returned when the server key is not trusted
+type HostKeyError struct {
+	Address     string
+	Fingerprint string
+	// Known holds the trusted keys of the server, as file:line: key. If empty, the server is
+	// unknown, otherwise its key changed.
+	Known []string
+}
+
+func (err *HostKeyError) Error() string {
+	if len(err.Known) == 0 {
+		return fmt.Sprintf("Unknown key %s for server %s. Check it and trust it with dr trust",
+			err.Fingerprint, err.Address)
+	}
+	return fmt.Sprintf("Key of server %s changed to %s! Someone could be impersonating it. "+
+		"Trusted keys:\n  %s", err.Address, err.Fingerprint, strings.Join(err.Known, "\n  "))
+}
+
+// knownHostsLock serializes the updates of the known hosts files done by all the clients
+var knownHostsLock sync.Mutex
+
+// hostKeyCallback builds the server key verification for the client configuration
+func hostKeyCallback(config DRClientSSHConfig) ssh.HostKeyCallback {
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = DefaultKnownHostsFile()
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		switch config.HostKeyPolicy {
+		case HostKeyPinned:
+			if fingerprint != config.ServerKeyFingerprint {
+				return &HostKeyError{
+					Address:     hostname,
+					Fingerprint: fingerprint,
+					Known:       []string{"pinned: " + config.ServerKeyFingerprint},
+				}
+			}
+			return nil
+		case HostKeyStrict:
+			return checkKnownHost(knownHostsFile, hostname, remote, key)
+		}
+
+		err := checkKnownHost(knownHostsFile, hostname, remote, key)
+		if keyErr, ok := err.(*HostKeyError); ok && len(keyErr.Known) == 0 {
+			log.Printf("Trusting key %s of new server %s", fingerprint, hostname)
+			return TrustServerKey(knownHostsFile, hostname, key)
+		}
+		return err
+	}
+}
+
+// checkKnownHost verifies the key against the known hosts file. A missing file has no keys.
+func checkKnownHost(knownHostsFile, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	if _, err := os.Stat(knownHostsFile); os.IsNotExist(err) {
+		return &HostKeyError{Address: hostname, Fingerprint: ssh.FingerprintSHA256(key)}
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("Cannot read known hosts: %s", err.Error())
+	}
+
+	err = callback(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		hostKeyErr := &HostKeyError{Address: hostname, Fingerprint: ssh.FingerprintSHA256(key)}
+		for _, known := range keyErr.Want {
+			hostKeyErr.Known = append(hostKeyErr.Known, fmt.Sprintf("%s:%d: %s",
+				known.Filename, known.Line, ssh.FingerprintSHA256(known.Key)))
+		}
+		return hostKeyErr
+	}
+	return err
+}
+
+// CheckServerKey verifies the server key against the known hosts file. The error is a
+// *HostKeyError if the key is not trusted.
+func CheckServerKey(knownHostsFile, address string, key ssh.PublicKey) error {
+	return checkKnownHost(knownHostsFile, address, &net.TCPAddr{}, key)
+}
+
+// TrustServerKey adds the key of the server to the known hosts file
+func TrustServerKey(knownHostsFile, address string, key ssh.PublicKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700); err != nil {
+		return fmt.Errorf("Cannot create known hosts directory: %s", err.Error())
+	}
+
+	file, err := os.OpenFile(knownHostsFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open known hosts: %s", err.Error())
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, key)
+	if _, err = file.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("Cannot write known hosts: %s", err.Error())
+	}
+	return nil
+}
+
+// errServerKeyFetched stops the handshake once the server key is known
+var errServerKeyFetched = errors.New("server key fetched")
+
+// FetchServerKey connects to the server and returns its key, without authenticating
+func FetchServerKey(address string) (ssh.PublicKey, error) {
+	var serverKey ssh.PublicKey
+
+	config := ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			serverKey = key
+			return errServerKeyFetched
+		},
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to %s: %s", address, err.Error())
+	}
+	defer conn.Close()
+
+	_, _, _, err = ssh.NewClientConn(conn, address, &config)
+	if serverKey == nil {
+		return nil, fmt.Errorf("Cannot get the key of %s: %v", address, err)
+	}
+	return serverKey, nil
+}
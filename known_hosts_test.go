@@ -0,0 +1,80 @@
+package dryred
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerKeyVerification(t *testing.T) {
+	const serverAddress string = "localhost:7012"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	connect := func(policy HostKeyPolicy, fingerprint string) error {
+		client, err := DRClientSSHNew(DRClientSSHConfig{
+			SSHKeyFileName:       "testdata/front_id_rsa",
+			SSHKeyPassPhrase:     "TestTest",
+			User:                 "elisescu",
+			HostKeyPolicy:        policy,
+			KnownHostsFile:       knownHosts,
+			ServerKeyFingerprint: fingerprint,
+		})
+		if err != nil {
+			t.Fatal("Can't create client: ", err)
+		}
+		// The back client is offline, but the server key is verified before that
+		_, err = client.Connect(serverAddress, "pi", "localhost:22")
+		if err != nil && strings.Contains(err.Error(), "offline") {
+			return nil
+		}
+		return err
+	}
+
+	if err := connect(HostKeyStrict, ""); err == nil {
+		t.Fatal("Strict policy accepted an unknown server")
+	}
+
+	if err := connect(HostKeyTOFU, ""); err != nil {
+		t.Fatalf("Server not trusted on first use: %s", err.Error())
+	}
+	if err := connect(HostKeyStrict, ""); err != nil {
+		t.Fatalf("Server key not recorded on first use: %s", err.Error())
+	}
+
+	serverKey, err := FetchServerKey(serverAddress)
+	if err != nil {
+		t.Fatalf("Can't fetch the server key: %s", err.Error())
+	}
+	if err := connect(HostKeyPinned, "SHA256:wrong"); err == nil {
+		t.Fatal("Pinned policy accepted the wrong fingerprint")
+	}
+	if err := connect(HostKeyPinned, ssh.FingerprintSHA256(serverKey)); err != nil {
+		t.Fatalf("Pinned policy refused the right fingerprint: %s", err.Error())
+	}
+
+	// Replace the recorded key with another one: the server now looks like an impostor
+	otherKey, err := os.ReadFile("testdata/back_id_rsa.pub")
+	if err != nil {
+		t.Fatal("Can't read back key: ", err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(otherKey)
+	if err != nil {
+		t.Fatal("Can't parse back key: ", err)
+	}
+	os.Remove(knownHosts)
+	if err = TrustServerKey(knownHosts, serverAddress, pubKey); err != nil {
+		t.Fatalf("Can't trust key: %s", err.Error())
+	}
+
+	var hostKeyErr *HostKeyError
+	err = connect(HostKeyTOFU, "")
+	if !errors.As(err, &hostKeyErr) || len(hostKeyErr.Known) != 1 {
+		t.Fatalf("Expected a key mismatch error, got: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package dryred
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDRClientListBackClients(t *testing.T) {
+	const serverAddress string = "localhost:7025"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew(nil))
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	backClients, err := frontClient.ListBackClients(context.Background(), serverAddress)
+	if err != nil {
+		t.Fatalf("Can't list the back clients: %s", err.Error())
+	}
+
+	if len(backClients) != 2 || backClients[0].Name != "pi" ||
+		backClients[1].Name != "raspberrypi_2" {
+		t.Fatalf("Unexpected back clients: %+v", backClients)
+	}
+	if !backClients[0].Online || backClients[0].RemoteAddress == "" ||
+		time.Since(backClients[0].ConnectedSince) > time.Minute {
+		t.Fatalf("Expected pi to be online: %+v", backClients[0])
+	}
+	if backClients[1].Online || !backClients[1].ConnectedSince.IsZero() {
+		t.Fatalf("Expected raspberrypi_2 to be offline: %+v", backClients[1])
+	}
+
+	// Only the front clients can list
+	if _, err = backClient.ListBackClients(context.Background(), serverAddress); err == nil {
+		t.Fatalf("A back client listed the back clients")
+	}
+}
@@ -0,0 +1,176 @@
+package dryred
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"sync"
+)
+
+// FWConn is a forwarded session accepted by the listener of a back client
+type FWConn interface {
+	net.Conn
+	// Request returns the connect request, with the front client name and the requested address
+	Request() FWConnectRequest_V1
+}
+
+type fwConn struct {
+	net.Conn
+	request FWConnectRequest_V1
+	// Called once, when the conn is closed
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (conn *fwConn) Close() error {
+	err := conn.Conn.Close()
+	conn.closeOnce.Do(conn.onClose)
+	return err
+}
+
+func (conn *fwConn) Request() FWConnectRequest_V1 {
+	return conn.request
+}
+
+// fwListenerAddr is the address of a back client listener: its name, as known by the server
+type fwListenerAddr struct {
+	backClient    string
+	serverAddress string
+}
+
+func (addr fwListenerAddr) Network() string {
+	return "dryred"
+}
+
+func (addr fwListenerAddr) String() string {
+	return addr.backClient + "@" + addr.serverAddress
+}
+
+type sshFWListener struct {
+	client    *sshDRClient
+	addr      fwListenerAddr
+	sshConn   ssh.Conn
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	// The accepted conns still open. Once the listener is closed, the connection to the server
+	// is closed with the last of them.
+	lock   sync.Mutex
+	active int
+	closed bool
+}
+
+func (client *sshDRClient) Listen(serverAddress string) (net.Listener, error) {
+	sshConn, tcpConn, sshChans, err := registerBackClient(context.Background(), client,
+		serverAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &sshFWListener{
+		client: client,
+		addr: fwListenerAddr{
+			backClient:    client.config.User,
+			serverAddress: serverAddress,
+		},
+		sshConn: sshConn,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		for newChannel := range sshChans {
+			if listener.isClosed() {
+				rejectWithCode(newChannel, ssh.ConnectionFailed, FWErrBackClientOffline,
+					fmt.Sprintf("Back client %s stopped listening", client.config.User))
+				continue
+			}
+			session, err := newFWSession(client, newChannel, tcpConn)
+			if err != nil {
+				log.Printf("Rejecting session: %s", err.Error())
+				continue
+			}
+			// The end-to-end handshake can be slow, so don't hold the other sessions
+			go listener.accept(session)
+		}
+		listener.Close()
+	}()
+
+	return listener, nil
+}
+
+func (listener *sshFWListener) accept(session FWSession) {
+	conn, err := session.Accept()
+	if err != nil {
+		log.Printf("Cannot accept session from %s: %s", session.Request().FrontClientName,
+			err.Error())
+		return
+	}
+
+	listener.lock.Lock()
+	if listener.closed {
+		listener.lock.Unlock()
+		conn.Close()
+		return
+	}
+	listener.active++
+	listener.lock.Unlock()
+
+	accepted := &fwConn{Conn: conn, request: session.Request(), onClose: listener.release}
+	select {
+	case listener.conns <- accepted:
+	case <-listener.done:
+		accepted.Close()
+	}
+}
+
+// release is called when an accepted conn is closed
+func (listener *sshFWListener) release() {
+	listener.lock.Lock()
+	listener.active--
+	last := listener.closed && listener.active == 0
+	listener.lock.Unlock()
+
+	if last {
+		listener.sshConn.Close()
+	}
+}
+
+func (listener *sshFWListener) isClosed() bool {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	return listener.closed
+}
+
+func (listener *sshFWListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, fmt.Errorf("Listener %s closed: %w", listener.addr, net.ErrClosed)
+	}
+}
+
+// Close stops accepting sessions: the new ones are refused. The accepted conns stay open, and
+// the connection to the server is closed once they are all closed.
+func (listener *sshFWListener) Close() error {
+	listener.closeOnce.Do(func() {
+		listener.lock.Lock()
+		listener.closed = true
+		idle := listener.active == 0
+		listener.lock.Unlock()
+
+		close(listener.done)
+		if idle {
+			listener.sshConn.Close()
+		}
+	})
+	return nil
+}
+
+func (listener *sshFWListener) Addr() net.Addr {
+	return listener.addr
+}
@@ -0,0 +1,123 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type frontClientKey struct{}
+
+func TestDRClientListen(t *testing.T) {
+	const serverAddress string = "localhost:7019"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	listener, err := backClient.Listen(serverAddress)
+	if err != nil {
+		t.Fatalf("Can't listen via the server: %s", err.Error())
+	}
+	defer listener.Close()
+
+	// An in-process web server on the device, with no local port
+	webServer := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request := r.Context().Value(frontClientKey{}).(FWConnectRequest_V1)
+			fmt.Fprintf(w, "hello %s, from %s", request.FrontClientName,
+				request.BackConnectionAddress)
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, frontClientKey{}, conn.(FWConn).Request())
+		},
+	}
+	go webServer.Serve(listener)
+
+	dialer := DRDialerNew(DRDialerConfig{
+		Client:        testClient(t, "testdata/front_id_rsa", "elisescu"),
+		ServerAddress: serverAddress,
+	})
+	defer dialer.Close()
+
+	httpClient := http.Client{
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+	}
+	// Many sessions are served on the same listener
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get("http://pi:8080/")
+		if err != nil {
+			t.Fatalf("Can't get the page: %s", err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello elisescu, from localhost:8080" {
+			t.Fatalf("Unexpected page: %q", body)
+		}
+		httpClient.CloseIdleConnections()
+	}
+
+	if listener.Addr().String() != "pi@"+serverAddress {
+		t.Fatalf("Unexpected listener address %s", listener.Addr())
+	}
+
+	listener.Close()
+	if _, err = listener.Accept(); err == nil {
+		t.Fatalf("Accepted on a closed listener")
+	}
+}
+
+func TestDRClientListenerCloseKeepsAcceptedConns(t *testing.T) {
+	const serverAddress string = "localhost:7041"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	listener, err := backClient.Listen(serverAddress)
+	if err != nil {
+		t.Fatalf("Can't listen via the server: %s", err.Error())
+	}
+	defer listener.Close()
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	frontConn, err := frontClient.Connect(serverAddress, "pi", "localhost:8080")
+	if err != nil {
+		t.Fatalf("Can't connect to the listener: %s", err.Error())
+	}
+	defer frontConn.Close()
+	backConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Can't accept: %s", err.Error())
+	}
+	go io.Copy(backConn, backConn)
+
+	listener.Close()
+
+	// The accepted conn still works, but no new session is accepted
+	checkEcho(t, frontConn)
+	_, err = frontClient.Connect(serverAddress, "pi", "localhost:8080")
+	if !errors.Is(err, ErrBackClientOffline) {
+		t.Fatalf("Expected the closed listener to refuse the session, got: %v", err)
+	}
+
+	// Closing the last accepted conn closes the connection to the server
+	backConn.Close()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- listener.(*sshFWListener).sshConn.Wait()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("The connection to the server is still open")
+	}
+}
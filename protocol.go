@@ -1,23 +1,149 @@
 package dryred
 
-const FWConnectRequestName = "connect"
+import (
+	"time"
+)
+
+// FWHelloRequestName is the first global request of the clients, right after the SSH handshake.
+// Both sides agree on the protocol version and the capabilities they have in common. The payload
+// is the FWHelloRequest_V1, and the reply, also when refused, the FWHelloReply_V1. The clients
+// not sending it talk version 1, with the base capabilities.
+const FWHelloRequestName = "hello"
+
+// FWProtocolVersion is the newest protocol version, and FWMinProtocolVersion the oldest one
+// still supported
+const FWProtocolVersion = 2
+const FWMinProtocolVersion = 1
+
+// The capabilities exchanged in the hello request. Unknown ones are ignored.
+const (
+	// FWCapMultiplexing is set when many forwarded sessions can share the same connection
+	FWCapMultiplexing = "mux"
+	// FWCapEndToEnd is set when the end-to-end sessions are forwarded
+	FWCapEndToEnd = "e2e"
+	// FWCapServices is set when the back clients can advertise named services
+	FWCapServices = "services"
+	// FWCapList is set when the front clients can list the back clients
+	FWCapList = "list"
+)
+
+type FWHelloRequest_V1 struct {
+	MinVersion int
+	MaxVersion int
+	Capabilities []string
+}
+
+type FWHelloReply_V1 struct {
+	Status bool
+	ErrorMessage string
+	// Version is the agreed protocol version, and Capabilities the ones both sides have
+	Version int
+	Capabilities []string
+}
+
+// FWConnectChannelName is the type of the SSH channel a front client opens on the server for every
+// forwarded session. The channel extra data is the FWConnectRequest_V1, and if the server refuses
+// it, the rejection message is the FWConnectReply_V1.
+const FWConnectChannelName = "connect"
 const FWListenRequestName = "listen"
 
+// FWForwardChannelName is the type of the SSH channel the server opens towards a back client for
+// every forwarded session. The channel extra data is the FWConnectRequest_V1 of the front client,
+// and if the back client refuses it, the rejection message is the FWConnectReply_V1.
+const FWForwardChannelName = "forward"
+
+// FWEndToEndChannelName is the type of the single channel the front client opens inside the
+// end-to-end SSH session it runs with the back client, over a forwarded session.
+const FWEndToEndChannelName = "e2e-session"
+
 type FWConnectRequest_V1 struct {
 	BackClientName string
 	BackConnectionAddress string
+	// FrontClientName is set by the server, on the forward channel to the back client
+	FrontClientName string
+	// ServiceName requests a service advertised by the back client, instead of an address. The
+	// back client resolves it to the BackConnectionAddress.
+	ServiceName string
+	// EndToEnd is set when the front client starts an end-to-end SSH handshake with the back
+	// client as soon as the forwarded session is open
+	EndToEnd bool
 }
 
+// FWErrorCode tells why a request was refused, so the clients don't have to parse the
+// ErrorMessage. Retryable is the hint sent with it: the same request can succeed later.
+type FWErrorCode string
+
+const (
+	// FWErrUnauthorized is sent when the client is not allowed to forward to the back client
+	FWErrUnauthorized FWErrorCode = "unauthorized"
+	// FWErrNotAFrontClient is sent when a back client makes a front client request
+	FWErrNotAFrontClient FWErrorCode = "not-a-front-client"
+	FWErrBackClientOffline FWErrorCode = "back-client-offline"
+	// FWErrForbiddenTarget is sent when the back client doesn't serve the address or service
+	FWErrForbiddenTarget FWErrorCode = "forbidden-target"
+	// FWErrDialFailed is sent when the back client can't connect to the address
+	FWErrDialFailed FWErrorCode = "dial-failed"
+	FWErrQuotaExceeded FWErrorCode = "quota-exceeded"
+	FWErrServerShuttingDown FWErrorCode = "server-shutting-down"
+	// FWErrBadRequest is sent when the request payload can't be parsed
+	FWErrBadRequest FWErrorCode = "bad-request"
+)
+
+// Retryable returns the default retry hint of the code
+func (code FWErrorCode) Retryable() bool {
+	switch code {
+	case FWErrBackClientOffline, FWErrDialFailed, FWErrQuotaExceeded, FWErrServerShuttingDown:
+		return true
+	}
+	return false
+}
+
+// The replies below carry an ErrorCode and a Retryable hint when refused. The peers older than
+// them send only the ErrorMessage.
+
 type FWConnectReply_V1 struct {
 	Status bool
 	ErrorMessage string
+	ErrorCode FWErrorCode
+	Retryable bool
 }
 
 type FWListenRequest_V1 struct {
 	Name string
+	// Services are the names of the services the back client serves, e.g. ssh or router
+	Services []string
+	// ServiceAddresses maps the services to the address the back client connects to, e.g. ssh
+	// to localhost:22, so that the server rules on addresses cover the services too
+	ServiceAddresses map[string]string
 }
 
 type FWListenReply_V1 struct {
 	Status bool
 	ErrorMessage string
+	ErrorCode FWErrorCode
+	Retryable bool
+}
+
+// FWListRequestName is the global request of a front client listing the back clients it can
+// forward to. The payload is the FWListRequest_V1, and the reply the FWListReply_V1.
+const FWListRequestName = "list"
+
+type FWListRequest_V1 struct {
+}
+
+type FWListReply_V1 struct {
+	Status bool
+	ErrorMessage string
+	ErrorCode FWErrorCode
+	Retryable bool
+	BackClients []FWBackClient_V1
+}
+
+type FWBackClient_V1 struct {
+	Name string
+	Online bool
+	// ConnectedSince and RemoteAddress are only set for the online back clients
+	ConnectedSince time.Time
+	RemoteAddress string
+	Services []string
 }
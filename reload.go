@@ -0,0 +1,119 @@
+package dryred
+
+import (
+	"log"
+	"time"
+)
+
+// forwardedSession is a forwarded session in progress on the server
+type forwardedSession struct {
+	front   ClientInfo
+	request FWConnectRequest_V1
+	target  ForwardTarget
+	// close ends the session, closing both its channels
+	close func()
+}
+
+func (server *sshDRServer) clients() ClientsDB {
+	server.clientsDBLock.RLock()
+	defer server.clientsDBLock.RUnlock()
+	return server.clientsDB
+}
+
+// currentClient returns the connected client as it is in the current clients database, or nil if
+// it was removed or got a new key or role since it connected
+func (server *sshDRServer) currentClient(client ClientInfo) ClientInfo {
+	current := server.clients().FindClientByName(client.Name())
+	if current == nil || current.PubKey() != client.PubKey() ||
+		current.FrontClient() != client.FrontClient() {
+		return nil
+	}
+	return current
+}
+
+func (server *sshDRServer) ReloadClientsDB(clientsDB ClientsDB) {
+	server.clientsDBLock.Lock()
+	oldClientsDB := server.clientsDB
+	server.clientsDB = clientsDB
+	server.clientsDBLock.Unlock()
+
+	logClientsDiff(oldClientsDB, clientsDB)
+
+	server.backClientsLock.Lock()
+	for _, back := range server.backClients {
+		if current := server.currentClient(back.info); current != nil {
+			back.info = current
+			continue
+		}
+		server.revoke(back.info, back.sshConn.Close)
+	}
+	server.backClientsLock.Unlock()
+
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	for sshConn, client := range server.frontConns {
+		if current := server.currentClient(client); current != nil {
+			server.frontConns[sshConn] = current
+			continue
+		}
+		server.revoke(client, sshConn.Close)
+	}
+
+	for session := range server.sessions {
+		front := server.currentClient(session.front)
+		back := clientsDB.FindClientByName(session.request.BackClientName)
+		if front != nil && back != nil && clientsDB.CheckForward(front, back, session.target,
+			time.Now()).Allowed {
+			continue
+		}
+
+		if !server.config.DropRevokedClients {
+			log.Printf("Session from %s to %s is no longer allowed, but stays open",
+				session.front.Name(), session.request.BackClientName)
+			continue
+		}
+		log.Printf("Closing the session from %s to %s: no longer allowed",
+			session.front.Name(), session.request.BackClientName)
+		session.close()
+	}
+}
+
+// revoke disconnects the client removed from the clients database, or only logs it
+func (server *sshDRServer) revoke(client ClientInfo, close func() error) {
+	if !server.config.DropRevokedClients {
+		log.Printf("Client %s was revoked, but stays connected", client.Name())
+		return
+	}
+	log.Printf("Client %s was revoked. Disconnecting it", client.Name())
+	close()
+}
+
+// logClientsDiff logs the clients added, removed, and changed by a reload
+func logClientsDiff(oldClientsDB, newClientsDB ClientsDB) {
+	changes := 0
+	for _, client := range newClientsDB.Clients() {
+		old := oldClientsDB.FindClientByName(client.Name())
+		switch {
+		case old == nil:
+			log.Printf("Client %s was added", client.Name())
+		case old.PubKey() != client.PubKey():
+			log.Printf("Client %s has a new key", client.Name())
+		case client.FrontClient() && !old.FrontClient():
+			log.Printf("Client %s is now a front client", client.Name())
+		case !client.FrontClient() && old.FrontClient():
+			log.Printf("Client %s is now a back client", client.Name())
+		default:
+			continue
+		}
+		changes++
+	}
+
+	for _, client := range oldClientsDB.Clients() {
+		if newClientsDB.FindClientByName(client.Name()) == nil {
+			log.Printf("Client %s was removed", client.Name())
+			changes++
+		}
+	}
+	log.Printf("Clients reloaded: %d changes", changes)
+}
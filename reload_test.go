@@ -0,0 +1,134 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClientsDB returns a clients database with only the given front and back test clients
+func testClientsDB(t *testing.T, front, back bool) ClientsDB {
+	content := ""
+	if front {
+		content += fmt.Sprintf("[[from]]\nclient_name = \"elisescu\"\npublic_key = \"%s\"\n",
+			readPubKey(t, "testdata/front_id_rsa.pub"))
+	}
+	if back {
+		content += fmt.Sprintf("[[to]]\nclient_name = \"pi\"\npublic_key = \"%s\"\n",
+			readPubKey(t, "testdata/back_id_rsa.pub"))
+	}
+
+	clientsDB, err := ClientsDBFromToml(writeClientsToml(t, content))
+	if err != nil {
+		t.Fatalf("Can't load the clients: %s", err.Error())
+	}
+	return clientsDB
+}
+
+func startReloadTestServer(t *testing.T, address string, dropRevoked bool) DRServer {
+	server, err := DRServerSSHNew(DRServerSSHConfig{
+		SSHServerKeyPassphrase: "TestTest",
+		SSHServerKeyFileName:   "testdata/server_id_rsa",
+		ClientsDB:              testClientsDB(t, true, true),
+		DropRevokedClients:     dropRevoked,
+	})
+	if err != nil {
+		t.Fatal("Can't create server: ", err)
+	}
+	go server.ListenAndServe(address)
+	time.Sleep(100 * time.Millisecond)
+	return server
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Can't write to the session: %s", err.Error())
+	}
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "hello" {
+		t.Fatalf("Unexpected echo %q: %v", buffer, err)
+	}
+}
+
+func TestDRServerReloadDropsRevokedClients(t *testing.T) {
+	const serverAddress string = "localhost:7032"
+	const targetAddress string = "localhost:7033"
+
+	defer startEchoServer(t, targetAddress).Close()
+	server := startReloadTestServer(t, serverAddress, true)
+	defer server.Stop()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	served := make(chan error, 1)
+	go func() {
+		served <- backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{targetAddress}))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	frontConn, err := frontClient.Connect(serverAddress, "pi", targetAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the back client: %s", err.Error())
+	}
+	defer frontConn.Close()
+	checkEcho(t, frontConn)
+
+	server.ReloadClientsDB(testClientsDB(t, true, false))
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("The removed back client is still connected")
+	}
+	if _, err = ioutil.ReadAll(frontConn); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("Unexpected error on the closed session: %s", err.Error())
+	}
+
+	_, err = frontClient.Connect(serverAddress, "pi", targetAddress)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected the removed back client to be unknown, got: %v", err)
+	}
+}
+
+func TestDRServerReloadKeepsRevokedClients(t *testing.T) {
+	const serverAddress string = "localhost:7034"
+	const targetAddress string = "localhost:7035"
+
+	defer startEchoServer(t, targetAddress).Close()
+	server := startReloadTestServer(t, serverAddress, false)
+	defer server.Stop()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{targetAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	serverConn, err := frontClient.DialServerContext(context.Background(), serverAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the server: %s", err.Error())
+	}
+	defer serverConn.Close()
+
+	frontConn, err := serverConn.ConnectContext(context.Background(), "pi", targetAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the back client: %s", err.Error())
+	}
+	defer frontConn.Close()
+
+	server.ReloadClientsDB(testClientsDB(t, false, true))
+
+	// The session in progress goes on, but no new one starts
+	checkEcho(t, frontConn)
+	_, err = serverConn.ConnectContext(context.Background(), "pi", targetAddress)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected the removed front client to be refused, got: %v", err)
+	}
+	if _, err = frontClient.Connect(serverAddress, "pi", targetAddress); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Expected the removed front client not to connect, got: %v", err)
+	}
+}
@@ -2,69 +2,163 @@ package dryred
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const directTCPIPChannelName = "direct-tcpip"
+
 // DRServer interface describing a forwarding server
 type DRServer interface {
 	ListenAndServe(address string) error
 	Stop() error
+	// ReloadClientsDB replaces the clients database, without dropping the sessions of the
+	// clients still in it
+	ReloadClientsDB(clientsDB ClientsDB)
 }
 
 type sshDRServer struct {
 	listener  net.Listener
-	clientsDB ClientsDB
 	sshConfig ssh.ServerConfig
+	config    DRServerSSHConfig
+
+	// The clients database can be replaced while serving. Read it with clients()
+	clientsDB     ClientsDB
+	clientsDBLock sync.RWMutex
+
+	// The back clients currently connected and waiting for a front client, indexed by name
+	backClients     map[string]*backClientConn
+	backClientsLock sync.Mutex
+	// stopping is set by Stop, so the requests still coming are refused as such
+	stopping bool
+
+	// The front client connections and the forwarded sessions in progress, re-checked when the
+	// clients database is reloaded
+	frontConns   map[ssh.Conn]ClientInfo
+	sessions     map[*forwardedSession]bool
+	sessionsLock sync.Mutex
+}
+
+// backClientConn is an authenticated back client connection, kept in the server registry for as
+// long as the back client stays connected. Every forwarded session is a new SSH channel on it.
+type backClientConn struct {
+	info    ClientInfo
+	sshConn ssh.Conn
+	since   time.Time
+	// The names of the services advertised by the back client
+	services []string
+	// The addresses of the services, if advertised
+	serviceAddresses map[string]string
 }
 
 // DRServerSSHConfig describes the configuration for a DRServer based on SSH auth/encrypt
 type DRServerSSHConfig struct {
-	ClientsDB              ClientsDB
-	SSHServerKeyFileName   string
-	SSHServerKeyPassphrase string
+	ClientsDB            ClientsDB
+	SSHServerKeyFileName string
+	// More host keys, usually of different types, e.g. ed25519 and rsa
+	SSHServerKeyFileNames []string
+	// The passphrase of encrypted keys is SSHServerKeyPassphrase, or else read from the
+	// SSHServerKeyPassphraseEnv environment variable, or from the SSHServerKeyPassphraseFile, or
+	// else asked on the terminal if AskPassphrase is set
+	SSHServerKeyPassphrase     string
+	SSHServerKeyPassphraseEnv  string
+	SSHServerKeyPassphraseFile string
+	AskPassphrase              bool
+
+	// HandshakeTimeout bounds the SSH handshake and the back client registration, by default 10s
+	HandshakeTimeout time.Duration
+	// KeepAliveInterval is how often the server checks that its clients are alive, by default
+	// 30s, or never if negative. A client not answering within KeepAliveTimeout, by default
+	// KeepAliveInterval, is disconnected, and so a back client goes offline right away.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	// IdleTimeout disconnects the clients that sent nothing, not even a keepalive reply, for so
+	// long. Never if zero.
+	IdleTimeout time.Duration
+	// DropRevokedClients disconnects, on ReloadClientsDB, the clients removed or with a new key,
+	// and ends the forwarded sessions no longer allowed. Otherwise they are only logged, and
+	// can't start new sessions.
+	DropRevokedClients bool
 }
 
 func DRServerSSHNew(config DRServerSSHConfig) (DRServer, error) {
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = 10 * time.Second
+	}
+	if config.KeepAliveInterval == 0 {
+		config.KeepAliveInterval = 30 * time.Second
+	}
+	if config.KeepAliveTimeout == 0 {
+		config.KeepAliveTimeout = config.KeepAliveInterval
+	}
+
 	server := &sshDRServer{
-		clientsDB: config.ClientsDB,
+		clientsDB:   config.ClientsDB,
+		config:      config,
+		backClients: make(map[string]*backClientConn),
+		frontConns:  make(map[ssh.Conn]ClientInfo),
+		sessions:    make(map[*forwardedSession]bool),
 	}
 
 	server.sshConfig = ssh.ServerConfig{
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			ok, front := authorizeKey(server, pubKey)
-			if ok {
-				return &ssh.Permissions{
-					Extensions: map[string]string{
-						"pubkey-fp":    ssh.FingerprintSHA256(pubKey),
-						"pubkey":       string(pubKey.Marshal()),
-						"front-client": strconv.FormatBool(front),
-					},
-				}, nil
+			client := authorizeKey(server, pubKey)
+			if client == nil {
+				return nil, fmt.Errorf("Unknown public key for %q", c.User())
+			}
+
+			// Plain ssh clients using the server as jump host can name the back client
+			// in the user name: frontuser:backclient
+			userName, backName := splitJumpUser(c.User())
+			if userName != client.Name() || (backName != "" && !client.FrontClient()) {
+				return nil, fmt.Errorf("Key of %s used for %q", client.Name(), c.User())
 			}
-			return nil, fmt.Errorf("Unknown public key for %q", c.User())
+
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"pubkey-fp":    ssh.FingerprintSHA256(pubKey),
+					"pubkey":       string(pubKey.Marshal()),
+					"client-name":  client.Name(),
+					"front-client": strconv.FormatBool(client.FrontClient()),
+					"back-client":  backName,
+				},
+			}, nil
 		},
 	}
 
-	privateBytes, err := ioutil.ReadFile(config.SSHServerKeyFileName)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot read SSH server key: %s", err.Error())
+	keyFileNames := config.SSHServerKeyFileNames
+	if config.SSHServerKeyFileName != "" {
+		keyFileNames = append([]string{config.SSHServerKeyFileName}, keyFileNames...)
+	}
+	if len(keyFileNames) == 0 {
+		return nil, fmt.Errorf("No SSH server key")
 	}
 
-	sshPrivateKey, err := ssh.ParsePrivateKeyWithPassphrase(privateBytes,
-		[]byte(config.SSHServerKeyPassphrase))
+	passphrase := sshKeyPassphrase{
+		passphrase: config.SSHServerKeyPassphrase,
+		envVar:     config.SSHServerKeyPassphraseEnv,
+		file:       config.SSHServerKeyPassphraseFile,
+		ask:        config.AskPassphrase,
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse private key: %s", err.Error())
+	for _, keyFileName := range keyFileNames {
+		sshPrivateKey, err := loadSSHPrivateKey(keyFileName, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load SSH server key: %s", err.Error())
+		}
+		// A key of the same type replaces the previous one
+		server.sshConfig.AddHostKey(sshPrivateKey)
 	}
 
-	server.sshConfig.AddHostKey(sshPrivateKey)
 	return server, nil
 }
 
@@ -83,129 +177,576 @@ func (server *sshDRServer) ListenAndServe(address string) (err error) {
 			return err
 		}
 
-		go handleConn(server.sshConfig, conn)
+		go server.handleConn(conn)
 	}
-	return nil
 }
 
 func (server *sshDRServer) Stop() error {
+	server.backClientsLock.Lock()
+	server.stopping = true
+	for name, back := range server.backClients {
+		back.sshConn.Close()
+		delete(server.backClients, name)
+	}
+	server.backClientsLock.Unlock()
+
 	return server.listener.Close()
 }
 
-func authorizeKey(server *sshDRServer, pubKey ssh.PublicKey) (authorized bool, frontClient bool) {
+func authorizeKey(server *sshDRServer, pubKey ssh.PublicKey) ClientInfo {
 	pubKeyString := encodeSSHPubKey(pubKey)
-	client := server.clientsDB.FindClientByPubKey(pubKeyString)
+	client := server.clients().FindClientByPubKey(pubKeyString)
 
 	if client != nil {
-		log.Printf("Authorized client with key: %s", ssh.FingerprintSHA256(pubKey))
-		return true, client.FrontClient()
+		log.Printf("Authorized client %s with key: %s", client.Name(),
+			ssh.FingerprintSHA256(pubKey))
 	}
 
-	return false, false
+	return client
 }
 
-func handleConn(sshConfig ssh.ServerConfig, conn net.Conn) {
-	// Proceed with the SSH handshake and authenticate the remote
-	connWrapper := ConnWrapperNoCloserNew(conn, func(closingConnection net.Conn) error {
-		return nil
-	})
+func (server *sshDRServer) handleConn(conn net.Conn) {
+	if server.config.IdleTimeout > 0 {
+		conn = &idleTimeoutConn{Conn: conn, timeout: server.config.IdleTimeout}
+	}
 
-	sshConn, sshChan, sshReq, err := ssh.NewServerConn(connWrapper, &sshConfig)
+	// The clients that don't complete the handshake and the registration in time are dropped
+	handshakeTimer := time.AfterFunc(server.config.HandshakeTimeout, func() { conn.Close() })
+	defer handshakeTimer.Stop()
+
+	// Proceed with the SSH handshake and authenticate the remote
+	sshConn, sshChan, sshReq, err := ssh.NewServerConn(conn, &server.sshConfig)
 
 	if err != nil {
 		log.Printf("SSH handshake error with client %s", conn.RemoteAddr().String())
+		conn.Close()
 		return
 	}
-	go discardSSHChans(sshChan)
-
-	select {
-	case newRequest := <-sshReq:
-		switch newRequest.Type {
-		case FWListenRequestName:
-			replyBuilder := func(allowed bool, errorMsg string) []byte {
-				reply, err := json.Marshal(FWListenReply_V1{
-					Status:       allowed,
-					ErrorMessage: errorMsg,
-				})
-				if err != nil {
-					panic(err)
-				}
-				return reply
-			}
-			var listenRequest FWListenRequest_V1
-			err = json.Unmarshal(newRequest.Payload, &listenRequest)
-			log.Printf("Got Listen request to from %s", listenRequest.Name)
 
-			allowed := sshConn.Permissions.Extensions["front-client"] != "true"
+	client := server.clients().FindClientByName(sshConn.Permissions.Extensions["client-name"])
+	if client == nil {
+		sshConn.Close()
+		return
+	}
+
+	if server.config.KeepAliveInterval > 0 {
+		go keepAlive(sshConn, server.config.KeepAliveInterval, server.config.KeepAliveTimeout)
+	}
+
+	if client.FrontClient() {
+		handshakeTimer.Stop()
+		server.sessionsLock.Lock()
+		server.frontConns[sshConn] = client
+		server.sessionsLock.Unlock()
+		defer func() {
+			server.sessionsLock.Lock()
+			delete(server.frontConns, sshConn)
+			server.sessionsLock.Unlock()
+		}()
+
+		// Front clients open a channel for each forwarded session
+		go server.handleFrontRequests(client, sshConn, sshReq)
+		server.handleFrontConnection(client, sshConn, sshChan)
+		return
+	}
+
+	// Back clients don't open channels. They are opened by the server
+	go refuseBackChannels(sshChan)
+
+	// The hello request is optional, for the clients older than it
+	newRequest, ok := <-sshReq
+	if ok && newRequest.Type == FWHelloRequestName {
+		server.handleHello(client, sshConn, newRequest)
+		newRequest, ok = <-sshReq
+	}
+	if !ok {
+		// Closed before the registration, or timed out
+		sshConn.Close()
+		return
+	}
+
+	if newRequest.Type != FWListenRequestName {
+		refuseBackRequest(newRequest)
+		sshConn.Close()
+		return
+	}
+	handshakeTimer.Stop()
+
+	replyBuilder := func(code FWErrorCode, errorMsg string) []byte {
+		reply, err := json.Marshal(FWListenReply_V1{
+			Status:       code == "",
+			ErrorMessage: errorMsg,
+			ErrorCode:    code,
+			Retryable:    code.Retryable(),
+		})
+		if err != nil {
+			panic(err)
+		}
+		return reply
+	}
+	var listenRequest FWListenRequest_V1
+	if err = json.Unmarshal(newRequest.Payload, &listenRequest); err != nil {
+		log.Printf("Cannot parse the listen request from %s: %s", client.Name(), err.Error())
+		newRequest.Reply(false, replyBuilder(FWErrBadRequest, "Cannot parse the listen request"))
+		sshConn.Close()
+		return
+	}
+	log.Printf("Got Listen request to from %s", listenRequest.Name)
+
+	if server.shuttingDown() {
+		newRequest.Reply(false, replyBuilder(FWErrServerShuttingDown, "The server is shutting down"))
+		sshConn.Close()
+		return
+	}
+
+	newRequest.Reply(true, replyBuilder("", ""))
+	go func() {
+		for req := range sshReq {
+			refuseBackRequest(req)
+		}
+	}()
+
+	server.handleBackConnection(client, sshConn, listenRequest)
+}
+
+// handleBackConnection keeps the authenticated back connection in the registry, for as long as
+// it stays open. A newer connection from the same back client replaces the old one.
+func (server *sshDRServer) handleBackConnection(client ClientInfo, sshConn ssh.Conn, listenRequest FWListenRequest_V1) {
+	back := &backClientConn{
+		info:             client,
+		sshConn:          sshConn,
+		since:            time.Now(),
+		services:         listenRequest.Services,
+		serviceAddresses: listenRequest.ServiceAddresses,
+	}
+
+	server.backClientsLock.Lock()
+	if old, ok := server.backClients[client.Name()]; ok {
+		log.Printf("Back client %s reconnected. Dropping its old connection", client.Name())
+		old.sshConn.Close()
+	}
+	server.backClients[client.Name()] = back
+	server.backClientsLock.Unlock()
+
+	log.Printf("Back client %s is online", client.Name())
+	sshConn.Wait()
+
+	server.backClientsLock.Lock()
+	if server.backClients[client.Name()] == back {
+		delete(server.backClients, client.Name())
+	}
+	server.backClientsLock.Unlock()
+	sshConn.Close()
+	log.Printf("Back client %s is offline", client.Name())
+}
+
+func (back *backClientConn) advertises(service string) bool {
+	for _, name := range back.services {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the target of the request checked by the rules: the service name with its
+// address, or else the address
+func (back *backClientConn) target(request FWConnectRequest_V1) ForwardTarget {
+	if request.ServiceName != "" {
+		return ForwardTarget{
+			Service: request.ServiceName,
+			Address: back.serviceAddresses[request.ServiceName],
+		}
+	}
+	return ForwardTarget{Address: request.BackConnectionAddress}
+}
+
+// findBackClient returns the connection of the back client named in the request, if the front
+// client is allowed to forward to its target.
+func (server *sshDRServer) findBackClient(frontClient ClientInfo, request FWConnectRequest_V1) (*backClientConn, error) {
+	backName := request.BackClientName
+	server.backClientsLock.Lock()
+	defer server.backClientsLock.Unlock()
+
+	if server.stopping {
+		return nil, rejectionNew(ssh.ConnectionFailed, FWErrServerShuttingDown,
+			"The server is shutting down")
+	}
+
+	back, ok := server.backClients[backName]
+	if !ok {
+		if server.clients().FindClientByName(backName) == nil {
+			return nil, rejectionNew(ssh.Prohibited, FWErrUnauthorized,
+				"Unknown back client %s", backName)
+		}
+		return nil, rejectionNew(ssh.ConnectionFailed, FWErrBackClientOffline,
+			"Back client %s is offline", backName)
+	}
 
-			if allowed {
-				newRequest.Reply(true, replyBuilder(true, ""))
-				// Close the SSH layer on top of the connection. Not needed anymore
-				sshConn.Close()
+	if server.currentClient(back.info) == nil {
+		return nil, rejectionNew(ssh.Prohibited, FWErrUnauthorized,
+			"Back client %s was revoked", backName)
+	}
 
-				handleBackConnection(conn)
-				return
+	if !server.clients().ForwardAllowedFromTo(frontClient, back.info) {
+		return nil, rejectionNew(ssh.Prohibited, FWErrUnauthorized,
+			"Forwarding from %s to %s is not allowed", frontClient.Name(), backName)
+	}
+
+	target := back.target(request)
+	decision := server.clients().CheckForward(frontClient, back.info, target, time.Now())
+	if !decision.Allowed {
+		log.Printf("Forwarding from %s to %s, %s denied by %s", frontClient.Name(), backName,
+			target, decision.Rule)
+		return nil, rejectionNew(ssh.Prohibited, FWErrForbiddenTarget,
+			"Forwarding from %s to %s, %s is not allowed", frontClient.Name(), backName, target)
+	}
+
+	return back, nil
+}
+
+// openBackSession opens a new forwarded session channel towards the back client named in the
+// request, and returns it with its target. The back client can refuse it, in which case its
+// reason is returned as error.
+func (server *sshDRServer) openBackSession(frontClient ClientInfo, request FWConnectRequest_V1) (ssh.Channel, ForwardTarget, error) {
+	back, err := server.findBackClient(frontClient, request)
+	if err != nil {
+		return nil, ForwardTarget{}, err
+	}
+	target := back.target(request)
+	request.FrontClientName = frontClient.Name()
+
+	if request.ServiceName != "" && !back.advertises(request.ServiceName) {
+		return nil, target, rejectionNew(ssh.Prohibited, FWErrForbiddenTarget,
+			"Back client %s has no service %s", request.BackClientName, request.ServiceName)
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		panic(err)
+	}
+
+	channel, reqs, err := back.sshConn.OpenChannel(FWForwardChannelName, payload)
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			return nil, target, backRejection(request.BackClientName, openErr)
+		}
+		// The back client connection is gone, but not yet out of the registry. Evict it now
+		back.sshConn.Close()
+		return nil, target, rejectionNew(ssh.ConnectionFailed, FWErrBackClientOffline,
+			"Cannot open a session to %s: %s", request.BackClientName, err.Error())
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return channel, target, nil
+}
+
+// handleFrontConnection serves the forwarded sessions opened by a front client, until it
+// disconnects.
+func (server *sshDRServer) handleFrontConnection(client ClientInfo, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	defer sshConn.Close()
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case FWConnectChannelName:
+			go server.handleConnectChannel(client, newChannel)
+		case directTCPIPChannelName:
+			go server.handleDirectTCPIPChannel(client,
+				sshConn.Permissions.Extensions["back-client"], newChannel)
+		case "session":
+			newChannel.Reject(ssh.Prohibited,
+				"No shell on the server. Use it as jump host: ssh -J user@server device")
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "Unknown channel type")
+		}
+	}
+}
+
+// handleFrontRequests answers the hello and list requests of a front client, and refuses the
+// others
+func (server *sshDRServer) handleFrontRequests(client ClientInfo, sshConn ssh.Conn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type == FWHelloRequestName {
+			server.handleHello(client, sshConn, req)
+			continue
+		}
+
+		if req.Type == FWListenRequestName {
+			reply, err := json.Marshal(FWListenReply_V1{
+				ErrorMessage: fmt.Sprintf("Client %s is not a back client", client.Name()),
+				ErrorCode:    FWErrUnauthorized,
+			})
+			if err != nil {
+				panic(err)
 			}
+			req.Reply(false, reply)
+			continue
+		}
 
-			newRequest.Reply(true, replyBuilder(false, "Not a back client"))
-			sshConn.Close()
-			conn.Close()
-		case FWConnectRequestName:
-			replyBuilder := func(allowed bool, errorMsg string) []byte {
-				reply, err := json.Marshal(FWConnectReply_V1{
-					Status:       allowed,
-					ErrorMessage: errorMsg,
-				})
-				if err != nil {
-					panic(err)
-				}
-				return reply
+		if req.Type != FWListRequestName {
+			if req.WantReply {
+				req.Reply(false, nil)
 			}
+			continue
+		}
+
+		listReply := FWListReply_V1{
+			ErrorMessage: fmt.Sprintf("Client %s was revoked", client.Name()),
+			ErrorCode:    FWErrUnauthorized,
+		}
+		if current := server.currentClient(client); current != nil {
+			listReply = FWListReply_V1{
+				Status:      true,
+				BackClients: server.listBackClients(current),
+			}
+		}
+		reply, err := json.Marshal(listReply)
+		if err != nil {
+			panic(err)
+		}
+		req.Reply(true, reply)
+	}
+}
 
-			var fwRequest FWConnectRequest_V1
-			err = json.Unmarshal(newRequest.Payload, &fwRequest)
-			log.Printf("Got Connect request to %s, addr: %s, %s",
-				fwRequest.BackClientName, fwRequest.BackConnectionAddress,
-				string(newRequest.Payload))
+// listBackClients returns the back clients the front client is allowed to forward to, sorted by
+// name
+func (server *sshDRServer) listBackClients(frontClient ClientInfo) []FWBackClient_V1 {
+	server.backClientsLock.Lock()
+	defer server.backClientsLock.Unlock()
+
+	backClients := []FWBackClient_V1{}
+	clientsDB := server.clients()
+	for _, client := range clientsDB.BackClients() {
+		if !clientsDB.ForwardAllowedFromTo(frontClient, client) {
+			continue
+		}
 
-			allowed := sshConn.Permissions.Extensions["front-client"] == "true"
+		info := FWBackClient_V1{
+			Name: client.Name(),
+		}
+		if back, ok := server.backClients[client.Name()]; ok && server.currentClient(back.info) != nil {
+			info.Online = true
+			info.ConnectedSince = back.since
+			info.RemoteAddress = back.sshConn.RemoteAddr().String()
+			info.Services = back.services
+		}
+		backClients = append(backClients, info)
+	}
 
-			if allowed {
-				newRequest.Reply(true, replyBuilder(true, ""))
-				// Close the SSH layer on top of the connection. Not needed anymore
-				sshConn.Close()
+	sort.Slice(backClients, func(i, j int) bool {
+		return backClients[i].Name < backClients[j].Name
+	})
+	return backClients
+}
 
-				handleFrontConnection(conn)
-				return
-			}
+func (server *sshDRServer) handleConnectChannel(client ClientInfo, newChannel ssh.NewChannel) {
+	rejectWith := func(reason ssh.RejectionReason, code FWErrorCode, errorMsg string) {
+		rejectWithCode(newChannel, reason, code, errorMsg)
+	}
 
-			newRequest.Reply(true, replyBuilder(false, "Not a front client"))
-			sshConn.Close()
-			conn.Close()
-		default:
-			newRequest.Reply(false, []byte("Unknown request: "+newRequest.Type))
-			sshConn.Close()
-			conn.Close()
+	var fwRequest FWConnectRequest_V1
+	if err := json.Unmarshal(newChannel.ExtraData(), &fwRequest); err != nil {
+		rejectWith(ssh.ConnectionFailed, "", "Cannot parse the connect request")
+		return
+	}
+	log.Printf("Got Connect request from %s to %s, addr: %s, service: %s", client.Name(),
+		fwRequest.BackClientName, fwRequest.BackConnectionAddress, fwRequest.ServiceName)
+
+	server.forwardChannel(client, newChannel, fwRequest, rejectWith)
+}
+
+// handleDirectTCPIPChannel serves the channels opened by plain ssh clients using the server as
+// jump host, e.g. ssh -J elisescu@server pi, or ssh -J elisescu:pi@server localhost. Without a
+// back client in the user name, the host is the back client name and the target is on localhost.
+func (server *sshDRServer) handleDirectTCPIPChannel(client ClientInfo, backName string, newChannel ssh.NewChannel) {
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "Cannot parse the direct-tcpip request")
+		return
+	}
+
+	port := strconv.Itoa(int(payload.Port))
+	fwRequest := FWConnectRequest_V1{
+		BackClientName:        backName,
+		BackConnectionAddress: net.JoinHostPort(payload.Host, port),
+	}
+	if backName == "" {
+		fwRequest.BackClientName = payload.Host
+		fwRequest.BackConnectionAddress = net.JoinHostPort("localhost", port)
+	}
+	log.Printf("Got direct-tcpip request from %s to %s, addr: %s", client.Name(),
+		fwRequest.BackClientName, fwRequest.BackConnectionAddress)
+
+	// Plain ssh clients only show the message
+	server.forwardChannel(client, newChannel, fwRequest, func(reason ssh.RejectionReason, code FWErrorCode, errorMsg string) {
+		newChannel.Reject(reason, errorMsg)
+	})
+}
+
+// forwardChannel opens the session to the back client and, if successful, forwards the data
+// between the front client channel and the back client one.
+func (server *sshDRServer) forwardChannel(client ClientInfo, newChannel ssh.NewChannel, fwRequest FWConnectRequest_V1,
+	rejectWith func(ssh.RejectionReason, FWErrorCode, string)) {
+	// The clients database could have been reloaded since the front client connected
+	current := server.currentClient(client)
+	if current == nil {
+		log.Printf("Refusing %s to connect to %s: the client was revoked", client.Name(),
+			fwRequest.BackClientName)
+		rejectWith(ssh.Prohibited, FWErrUnauthorized,
+			fmt.Sprintf("Client %s was revoked", client.Name()))
+		return
+	}
+	client = current
+
+	backChannel, target, err := server.openBackSession(client, fwRequest)
+	if err != nil {
+		log.Printf("Refusing %s to connect to %s: %s", client.Name(),
+			fwRequest.BackClientName, err.Error())
+		reason := ssh.Prohibited
+		code := FWErrForbiddenTarget
+		var refused *rejection
+		if errors.As(err, &refused) {
+			reason = refused.reason
+			code = refused.code
 		}
-	case <-time.After(time.Second * 5):
-		sshConn.Close()
-		conn.Close()
-		break
+		rejectWith(reason, code, err.Error())
+		return
 	}
+
+	frontChannel, reqs, err := newChannel.Accept()
+	if err != nil {
+		backChannel.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	session := &forwardedSession{
+		front:   client,
+		request: fwRequest,
+		target:  target,
+		close: func() {
+			frontChannel.Close()
+			backChannel.Close()
+		},
+	}
+	server.sessionsLock.Lock()
+	server.sessions[session] = true
+	server.sessionsLock.Unlock()
+
+	forwardConnections(frontChannel, backChannel)
+
+	server.sessionsLock.Lock()
+	delete(server.sessions, session)
+	server.sessionsLock.Unlock()
 }
 
-func handleBackConnection(backConn net.Conn) {
-	// The connection is authenticated at this point. Keep it open and keep track of it
+// rejection is the refusal of a forwarded session, with the reason sent to the front client:
+// ssh.ConnectionFailed when the back client is offline, ssh.Prohibited when not allowed. The
+// code tells the newer clients more precisely why.
+type rejection struct {
+	reason  ssh.RejectionReason
+	code    FWErrorCode
+	message string
 }
 
-func handleFrontConnection(frontConn net.Conn) {
-	// Find the corresponding back connection and hook them up?
+func rejectionNew(reason ssh.RejectionReason, code FWErrorCode, format string, args ...interface{}) error {
+	return &rejection{
+		reason:  reason,
+		code:    code,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+// backRejection is the refusal of a forwarded session by the back client. The back clients older
+// than the error codes send only a message, and they refuse only the targets they don't allow.
+func backRejection(backName string, openErr *ssh.OpenChannelError) error {
+	reply := FWConnectReply_V1{
+		ErrorMessage: openErr.Message,
+		ErrorCode:    FWErrForbiddenTarget,
+	}
+	json.Unmarshal([]byte(openErr.Message), &reply)
+
+	return rejectionNew(openErr.Reason, reply.ErrorCode,
+		"Back client %s refused the connection: %s", backName, reply.ErrorMessage)
+}
 
-	// TODO: get here the back conn and pass it to the function bellow
-	go forwardConnections(frontConn, frontConn)
+func (server *sshDRServer) shuttingDown() bool {
+	server.backClientsLock.Lock()
+	defer server.backClientsLock.Unlock()
+	return server.stopping
 }
 
-func forwardConnections(conn1, conn2 net.Conn) {
-	go io.Copy(conn1, conn2)
-	//go io.Copy(conn2, conn1)
+// refuseBackRequest refuses the requests of a back client other than hello and listen
+func refuseBackRequest(req *ssh.Request) {
+	if req.Type == FWListRequestName {
+		reply, err := json.Marshal(FWListReply_V1{
+			ErrorMessage: "Only the front clients can list the back clients",
+			ErrorCode:    FWErrNotAFrontClient,
+		})
+		if err != nil {
+			panic(err)
+		}
+		req.Reply(false, reply)
+		return
+	}
+	if req.WantReply {
+		req.Reply(false, []byte("Unknown request: "+req.Type))
+	}
+}
+
+// refuseBackChannels refuses the channels opened by a back client. Only the front clients open
+// forwarded sessions.
+func refuseBackChannels(chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		if newChannel.ChannelType() != FWConnectChannelName {
+			newChannel.Reject(ssh.UnknownChannelType, "Unexpected channel type")
+			continue
+		}
+		rejectWithCode(newChannel, ssh.Prohibited, FWErrNotAFrontClient,
+			"Only the front clients can open forwarded sessions")
+	}
+}
+
+func (err *rejection) Error() string {
+	return err.message
+}
+
+// directTCPIPPayload is the extra data of a direct-tcpip channel, RFC 4254 section 7.2
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// splitJumpUser splits a frontuser:backclient user name
+func splitJumpUser(user string) (userName, backName string) {
+	parts := strings.SplitN(user, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return user, ""
+}
+
+// forwardConnections copies the data in both directions. When one side is done sending, the
+// write side of the other one is closed, if possible, and both are closed at the end.
+func forwardConnections(conn1, conn2 io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if halfCloser, ok := dst.(interface{ CloseWrite() error }); ok {
+			halfCloser.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(conn1, conn2)
+	go copyHalf(conn2, conn1)
+	wg.Wait()
+
+	conn1.Close()
+	conn2.Close()
 }
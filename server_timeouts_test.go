@@ -0,0 +1,70 @@
+package dryred
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDRServerTimeouts(t *testing.T) {
+	const serverAddress string = "localhost:7023"
+	const proxyAddress string = "localhost:7024"
+
+	clientsDB, err := ClientsDBFromToml("testdata/clients.toml")
+	if err != nil {
+		t.Fatal("Cant read the clients.toml file: ", err)
+	}
+	server, err := DRServerSSHNew(DRServerSSHConfig{
+		SSHServerKeyPassphrase: "TestTest",
+		SSHServerKeyFileName:   "testdata/server_id_rsa",
+		ClientsDB:              clientsDB,
+		HandshakeTimeout:       200 * time.Millisecond,
+		KeepAliveInterval:      100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Can't create server: ", err)
+	}
+	go server.ListenAndServe(serverAddress)
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// A client that never starts the handshake is dropped
+	conn, err := net.Dial("tcp", serverAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the server: %s", err.Error())
+	}
+	start := time.Now()
+	ioutil.ReadAll(conn)
+	conn.Close()
+	if time.Since(start) > time.Second {
+		t.Fatalf("The silent client was dropped only after %s", time.Since(start))
+	}
+
+	// A back client behind a dead network path is evicted by the keepalives
+	proxy := startBlackholeProxy(t, proxyAddress, serverAddress)
+	defer proxy.listener.Close()
+
+	backClient := testClient(t, "testdata/back_id_rsa", "pi")
+	go backClient.ServeViaServer(proxyAddress, FWDialHandlerNew(nil))
+	time.Sleep(200 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	_, err = frontClient.Connect(serverAddress, "pi", "localhost:22")
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected the back client to refuse the address, got: %v", err)
+	}
+
+	proxy.freeze()
+	time.Sleep(500 * time.Millisecond)
+
+	start = time.Now()
+	_, err = frontClient.Connect(serverAddress, "pi", "localhost:22")
+	if !errors.Is(err, ErrBackClientOffline) {
+		t.Fatalf("Expected the dead back client to be offline, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("The offline answer took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,78 @@
+package dryred
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDRBackClientServices(t *testing.T) {
+	const serverAddress string = "localhost:7026"
+	const echoAddress string = "localhost:7027"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	defer startEchoServer(t, echoAddress).Close()
+
+	backClient, err := DRClientSSHNew(DRClientSSHConfig{
+		SSHKeyFileName:   "testdata/back_id_rsa",
+		SSHKeyPassPhrase: "TestTest",
+		User:             "pi",
+		KnownHostsFile:   filepath.Join(t.TempDir(), "known_hosts"),
+		Services: map[string]string{
+			"echo": echoAddress,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Can't create back client: %s", err.Error())
+	}
+	go backClient.ServeViaServer(serverAddress, FWDialHandlerNew([]string{echoAddress}))
+	time.Sleep(100 * time.Millisecond)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+
+	backClients, err := frontClient.ListBackClients(context.Background(), serverAddress)
+	if err != nil {
+		t.Fatalf("Can't list the back clients: %s", err.Error())
+	}
+	if len(backClients[0].Services) != 1 || backClients[0].Services[0] != "echo" {
+		t.Fatalf("Expected pi to advertise the echo service: %+v", backClients[0])
+	}
+
+	dialer := DRDialerNew(DRDialerConfig{
+		Client:        frontClient,
+		ServerAddress: serverAddress,
+	})
+	defer dialer.Close()
+
+	// The service is requested by name, and resolved by the back client
+	for _, dial := range []func() (io.ReadWriteCloser, error){
+		func() (io.ReadWriteCloser, error) {
+			return frontClient.Connect(serverAddress, "pi", "echo")
+		},
+		func() (io.ReadWriteCloser, error) {
+			return dialer.Dial("tcp", "echo.pi:1")
+		},
+	} {
+		conn, err := dial()
+		if err != nil {
+			t.Fatalf("Can't connect to the echo service: %s", err.Error())
+		}
+		input := []byte("hello service")
+		conn.Write(input)
+		output := make([]byte, len(input))
+		if _, err := io.ReadFull(conn, output); err != nil || !slice_eq(input, output) {
+			t.Fatalf("The echo service answered %q, %v", output, err)
+		}
+		conn.Close()
+	}
+
+	_, err = frontClient.Connect(serverAddress, "pi", "web")
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected the unadvertised service to be refused, got: %v", err)
+	}
+}
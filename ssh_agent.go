@@ -0,0 +1,66 @@
+package dryred
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+)
+
+// agentSigners returns the signers backed by the ssh-agent listening on SSH_AUTH_SOCK: all of
+// them, or only the key selected by its SHA256 fingerprint or comment. The connection to the
+// agent stays open, as it is used on every handshake.
+func agentSigners(selector string) ([]ssh.Signer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("No ssh-agent: SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to ssh-agent: %s", err.Error())
+	}
+
+	agentClient := agent.NewClient(conn)
+	keys, err := agentClient.List()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot list the ssh-agent keys: %s", err.Error())
+	}
+
+	var selected *agent.Key
+	for _, key := range keys {
+		if selector == key.Comment || selector == ssh.FingerprintSHA256(key) {
+			selected = key
+			break
+		}
+	}
+
+	if len(keys) == 0 || (selector != "" && selected == nil) {
+		conn.Close()
+		if selector == "" {
+			return nil, fmt.Errorf("The ssh-agent has no keys")
+		}
+		return nil, fmt.Errorf("No ssh-agent key matching %q", selector)
+	}
+
+	signers, err := agentClient.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot get the ssh-agent signers: %s", err.Error())
+	}
+	if selector == "" {
+		return signers, nil
+	}
+
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), selected.Marshal()) {
+			return []ssh.Signer{signer}, nil
+		}
+	}
+
+	conn.Close()
+	return nil, fmt.Errorf("The ssh-agent key %s disappeared", ssh.FingerprintSHA256(selected))
+}
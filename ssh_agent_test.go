@@ -0,0 +1,142 @@
+package dryred
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func frontTestKey(t *testing.T) interface{} {
+	keyBytes, err := ioutil.ReadFile("testdata/front_id_rsa")
+	if err != nil {
+		t.Fatal("Can't read front key: ", err)
+	}
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(keyBytes, []byte("TestTest"))
+	if err != nil {
+		t.Fatal("Can't parse front key: ", err)
+	}
+	return key
+}
+
+func randomTestKey(t *testing.T) interface{} {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Can't generate a key: ", err)
+	}
+	return key
+}
+
+// startTestAgent serves an in-memory ssh-agent holding the keys, commented key0@test, key1@test...
+func startTestAgent(t *testing.T, keys ...interface{}) {
+	keyring := agent.NewKeyring()
+	for i, key := range keys {
+		comment := fmt.Sprintf("key%d@test", i)
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+			t.Fatal("Can't add key to the agent: ", err)
+		}
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal("Can't listen for the agent: ", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+}
+
+// connectAsFront authenticates as the front client, and returns nil if the server accepted it
+func connectAsFront(t *testing.T, serverAddress string, config DRClientSSHConfig) error {
+	config.User = "elisescu"
+	config.KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+
+	client, err := DRClientSSHNew(config)
+	if err != nil {
+		return err
+	}
+	// The back client is offline, which is only known after authentication
+	_, err = client.Connect(serverAddress, "pi", "localhost:22")
+	if err != nil && strings.Contains(err.Error(), "offline") {
+		return nil
+	}
+	return err
+}
+
+func TestDRClientWithAgent(t *testing.T) {
+	const serverAddress string = "localhost:7013"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+	startTestAgent(t, frontTestKey(t))
+
+	connect := func(config DRClientSSHConfig) error {
+		return connectAsFront(t, serverAddress, config)
+	}
+
+	if err := connect(DRClientSSHConfig{UseAgent: true}); err != nil {
+		t.Fatalf("Can't authenticate with the agent key: %s", err.Error())
+	}
+	if err := connect(DRClientSSHConfig{UseAgent: true, AgentKey: "key0@test"}); err != nil {
+		t.Fatalf("Can't authenticate with the agent key selected by comment: %s", err.Error())
+	}
+	if err := connect(DRClientSSHConfig{UseAgent: true, AgentKey: "other"}); err == nil {
+		t.Fatal("Selected a key that is not in the agent")
+	}
+
+	// Without a matching agent key, the key file is used
+	if err := connect(DRClientSSHConfig{
+		UseAgent:         true,
+		AgentKey:         "other",
+		SSHKeyFileName:   "testdata/front_id_rsa",
+		SSHKeyPassPhrase: "TestTest",
+	}); err != nil {
+		t.Fatalf("Didn't fall back to the key file: %s", err.Error())
+	}
+}
+
+func TestDRClientWithMultiKeyAgent(t *testing.T) {
+	const serverAddress string = "localhost:7039"
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+
+	// All the agent keys are offered, not only the first
+	startTestAgent(t, randomTestKey(t), randomTestKey(t), frontTestKey(t))
+	if err := connectAsFront(t, serverAddress, DRClientSSHConfig{UseAgent: true}); err != nil {
+		t.Fatalf("Can't authenticate with the third agent key: %s", err.Error())
+	}
+
+	// The key file is offered after the agent keys. Its passphrase is needed only if used.
+	startTestAgent(t, randomTestKey(t), randomTestKey(t))
+	if err := connectAsFront(t, serverAddress, DRClientSSHConfig{
+		UseAgent:         true,
+		SSHKeyFileName:   "testdata/front_id_rsa",
+		SSHKeyPassPhrase: "TestTest",
+	}); err != nil {
+		t.Fatalf("Didn't offer the key file after the agent keys: %s", err.Error())
+	}
+
+	if err := connectAsFront(t, serverAddress, DRClientSSHConfig{
+		UseAgent:       true,
+		SSHKeyFileName: "testdata/front_id_rsa",
+	}); err == nil {
+		t.Fatalf("Authenticated with the encrypted key file, without its passphrase")
+	}
+}
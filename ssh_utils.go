@@ -1,14 +1,22 @@
 package dryred
 
 import (
+	"bytes"
 	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"github.com/elisescu/speakeasy"
 	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 	"encoding/base64"
+	"encoding/json"
 )
 
 type CloseCallback func(net.Conn) error
@@ -46,39 +54,386 @@ func (conn ConnWrapperNoCloser)RemoteAddr() net.Addr {
 }
 
 func (conn ConnWrapperNoCloser)SetDeadline(t time.Time) error {
-	return nil // conn.innerConnection.SetDeadline(t)
+	return conn.innerConnection.SetDeadline(t)
 }
 
 func (conn ConnWrapperNoCloser)SetReadDeadline(t time.Time) error {
-	return nil //conn.innerConnection.SetReadDeadline(t)
+	return conn.innerConnection.SetReadDeadline(t)
 }
 
 func (conn ConnWrapperNoCloser)SetWriteDeadline(t time.Time) error {
-	return nil //conn.innerConnection.SetWriteDeadline(t)
+	return conn.innerConnection.SetWriteDeadline(t)
 }
 
-func decryptSSHKey(key []byte, password string) ([]byte, error) {
-	block, rest := pem.Decode(key)
-	if len(rest) > 0 {
-		return nil, fmt.Errorf("Can't decode pem key")
+// idleTimeoutConn fails the reads, and so the SSH connection on top of it, when nothing is received
+// for timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *idleTimeoutConn) Read(b []byte) (int, error) {
+	conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Read(b)
+}
+
+// sshChannelConn exposes an SSH channel as a net.Conn
+type sshChannelConn struct {
+	ssh.Channel
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	// Called after the channel is closed, if not nil
+	onClose func() error
+
+	readDeadline  *channelDeadline
+	writeDeadline *channelDeadline
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	// The channel is read by a goroutine, so that a deadline can unblock Read
+	readLock    sync.Mutex
+	readerOnce  sync.Once
+	reads       chan []byte
+	readErr     error
+	readPending []byte
+
+	// A write runs in its own goroutine only while a write deadline is set, and the next write
+	// waits for it
+	writeLock    sync.Mutex
+	writePending chan struct{}
+}
+
+type channelWriteResult struct {
+	n   int
+	err error
+}
+
+func sshChannelConnNew(channel ssh.Channel, localAddr, remoteAddr net.Addr, onClose func() error) *sshChannelConn {
+	return &sshChannelConn{
+		Channel:       channel,
+		localAddr:     localAddr,
+		remoteAddr:    remoteAddr,
+		onClose:       onClose,
+		readDeadline:  channelDeadlineNew(),
+		writeDeadline: channelDeadlineNew(),
+		closed:        make(chan struct{}),
+		reads:         make(chan []byte),
 	}
+}
 
-	if x509.IsEncryptedPEMBlock(block) {
-		if password == "" {
-			pass, err := speakeasy.Ask("Enter ssh key passphrase:")
-			if err != nil {
-				return nil, fmt.Errorf("Can't read password from stdin: %s",
-					err.Error())
+func (conn *sshChannelConn) readChannel() {
+	for {
+		buffer := make([]byte, 32*1024)
+		n, err := conn.Channel.Read(buffer)
+		if n > 0 {
+			select {
+			case conn.reads <- buffer[:n]:
+			case <-conn.closed:
+				return
 			}
-			password = pass
 		}
-		der, err := x509.DecryptPEMBlock(block, []byte(password))
 		if err != nil {
-			return nil, fmt.Errorf("Can't descrypt pem key: %s", err.Error())
+			conn.readErr = err
+			close(conn.reads)
+			return
+		}
+	}
+}
+
+func (conn *sshChannelConn) Read(data []byte) (int, error) {
+	conn.readLock.Lock()
+	defer conn.readLock.Unlock()
+
+	if len(conn.readPending) == 0 {
+		conn.readerOnce.Do(func() { go conn.readChannel() })
+		select {
+		case <-conn.readDeadline.expired():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+
+		select {
+		case buffer, ok := <-conn.reads:
+			if !ok {
+				return 0, conn.readErr
+			}
+			conn.readPending = buffer
+		case <-conn.readDeadline.expired():
+			return 0, os.ErrDeadlineExceeded
+		case <-conn.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(data, conn.readPending)
+	conn.readPending = conn.readPending[n:]
+	return n, nil
+}
+
+func (conn *sshChannelConn) Write(data []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	expired := conn.writeDeadline.expired()
+	if conn.writePending != nil {
+		select {
+		case <-conn.writePending:
+			conn.writePending = nil
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
 		}
-		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), nil
 	}
-	return key, nil
+	select {
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	if !conn.writeDeadline.isSet() {
+		return conn.Channel.Write(data)
+	}
+
+	// The write may outlive this call, so it gets its own copy of the data
+	data = append([]byte(nil), data...)
+	pending := make(chan struct{})
+	result := make(chan channelWriteResult, 1)
+	go func() {
+		n, err := conn.Channel.Write(data)
+		result <- channelWriteResult{n, err}
+		close(pending)
+	}()
+
+	select {
+	case written := <-result:
+		return written.n, written.err
+	case <-expired:
+		conn.writePending = pending
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (conn *sshChannelConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	err := conn.Channel.Close()
+	if conn.onClose != nil {
+		conn.onClose()
+	}
+	return err
+}
+
+func (conn *sshChannelConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn *sshChannelConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *sshChannelConn) SetDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+func (conn *sshChannelConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	return nil
+}
+
+func (conn *sshChannelConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+// channelDeadline is a deadline of an sshChannelConn: its expired channel is closed when the
+// deadline passes, and replaced when the deadline is moved again into the future
+type channelDeadline struct {
+	lock     sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	expiry   chan struct{}
+}
+
+func channelDeadlineNew() *channelDeadline {
+	return &channelDeadline{expiry: make(chan struct{})}
+}
+
+func (deadline *channelDeadline) set(t time.Time) {
+	deadline.lock.Lock()
+	defer deadline.lock.Unlock()
+
+	if deadline.timer != nil && !deadline.timer.Stop() {
+		// The timer already fired and closed the expiry channel
+		<-deadline.expiry
+	}
+	deadline.timer = nil
+	deadline.deadline = t
+
+	select {
+	case <-deadline.expiry:
+		deadline.expiry = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		expiry := deadline.expiry
+		deadline.timer = time.AfterFunc(wait, func() { close(expiry) })
+	} else {
+		close(deadline.expiry)
+	}
+}
+
+func (deadline *channelDeadline) isSet() bool {
+	deadline.lock.Lock()
+	defer deadline.lock.Unlock()
+	return !deadline.deadline.IsZero()
+}
+
+func (deadline *channelDeadline) expired() chan struct{} {
+	deadline.lock.Lock()
+	defer deadline.lock.Unlock()
+	return deadline.expiry
+}
+
+// sshKeyPassphrase tells where the passphrase of an encrypted private key comes from. The
+// sources are tried in this order: the passphrase itself, the environment variable, the file,
+// and finally the user is asked, if allowed.
+type sshKeyPassphrase struct {
+	passphrase string
+	envVar     string
+	file       string
+	ask        bool
+}
+
+func (source sshKeyPassphrase) get(keyFileName string) (string, error) {
+	if source.passphrase != "" {
+		return source.passphrase, nil
+	}
+
+	if source.envVar != "" {
+		if passphrase, ok := os.LookupEnv(source.envVar); ok {
+			return passphrase, nil
+		}
+	}
+
+	if source.file != "" {
+		data, err := ioutil.ReadFile(source.file)
+		if err != nil {
+			return "", fmt.Errorf("Can't read passphrase file: %s", err.Error())
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if source.ask {
+		passphrase, err := speakeasy.Ask("Enter passphrase for " + keyFileName + ": ")
+		if err != nil {
+			return "", fmt.Errorf("Can't read passphrase from stdin: %s", err.Error())
+		}
+		return passphrase, nil
+	}
+
+	return "", fmt.Errorf("Key %s is encrypted, and no passphrase was given", keyFileName)
+}
+
+// loadSSHPrivateKey reads a private key, in PEM or OpenSSH format, of any type supported by the
+// ssh package: rsa, ecdsa, ed25519. The passphrase is only needed for encrypted keys.
+func loadSSHPrivateKey(keyFileName string, source sshKeyPassphrase) (ssh.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read SSH private key: %s", err.Error())
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return nil, fmt.Errorf("Failed to parse private key %s: %s", keyFileName, err.Error())
+	}
+
+	passphrase, err := source.get(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	if err == x509.IncorrectPasswordError {
+		return nil, fmt.Errorf("Wrong passphrase for key %s", keyFileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt private key %s: %s", keyFileName, err.Error())
+	}
+	return signer, nil
+}
+
+// lazyKeySigner is a private key loaded only when it signs, e.g. when the server accepted its
+// public key. Its passphrase is not asked in vain when another key is used.
+type lazyKeySigner struct {
+	publicKey ssh.PublicKey
+	load      func() (ssh.Signer, error)
+	once      sync.Once
+	signer    ssh.Signer
+	err       error
+}
+
+func (lazy *lazyKeySigner) loaded() (ssh.Signer, error) {
+	lazy.once.Do(func() {
+		lazy.signer, lazy.err = lazy.load()
+		if lazy.err == nil &&
+			!bytes.Equal(lazy.signer.PublicKey().Marshal(), lazy.publicKey.Marshal()) {
+			lazy.err = fmt.Errorf("The private key doesn't match the public key %s",
+				ssh.FingerprintSHA256(lazy.publicKey))
+		}
+	})
+	return lazy.signer, lazy.err
+}
+
+func (lazy *lazyKeySigner) PublicKey() ssh.PublicKey {
+	return lazy.publicKey
+}
+
+func (lazy *lazyKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := lazy.loaded()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+func (lazy *lazyKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := lazy.loaded()
+	if err != nil {
+		return nil, err
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("The key can't sign with %s", algorithm)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// loadSSHPrivateKeyLazily returns the key as lazyKeySigner when its public key is next to it, in
+// the .pub file, or else loads it right away
+func loadSSHPrivateKeyLazily(keyFileName string, source sshKeyPassphrase) (ssh.Signer, error) {
+	pubKeyBytes, err := ioutil.ReadFile(keyFileName + ".pub")
+	if err != nil {
+		return loadSSHPrivateKey(keyFileName, source)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return loadSSHPrivateKey(keyFileName, source)
+	}
+
+	return &lazyKeySigner{
+		publicKey: pubKey,
+		load: func() (ssh.Signer, error) {
+			return loadSSHPrivateKey(keyFileName, source)
+		},
+	}, nil
 }
 
 func encodeSSHPubKey(pubKey ssh.PublicKey) string {
@@ -93,7 +448,66 @@ func discardSSHRequests(in <-chan *ssh.Request) {
 	}
 }
 
+// keepAliveRequestName is sent by the clients to check the connection. Any reply will do.
+const keepAliveRequestName = "keepalive@dryred"
+
+// keepAlive sends a keepalive request every interval, and closes the connection if no reply comes
+// within timeout, e.g. when a NAT dropped it silently. It returns once the connection is closed.
+func keepAlive(conn ssh.Conn, interval, timeout time.Duration) {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		replies := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest(keepAliveRequestName, true, nil)
+			replies <- err
+		}()
+
+		select {
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-time.After(timeout):
+			log.Printf("No keepalive reply from %s in %s. Closing the connection",
+				conn.RemoteAddr(), timeout)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// rejectWithCode refuses a forwarded session channel. The message is the FWConnectReply_V1.
+func rejectWithCode(newChannel ssh.NewChannel, reason ssh.RejectionReason, code FWErrorCode, message string) error {
+	reply, err := json.Marshal(FWConnectReply_V1{
+		Status:       false,
+		ErrorMessage: message,
+		ErrorCode:    code,
+		Retryable:    code.Retryable(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return newChannel.Reject(reason, string(reply))
+}
+
 func discardSSHChans(in <-chan ssh.NewChannel) {
-	for range in {
+	for newChannel := range in {
+		newChannel.Reject(ssh.UnknownChannelType, "Unexpected channel type")
 	}
 }
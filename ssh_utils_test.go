@@ -0,0 +1,236 @@
+package dryred
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeOpenSSHKey writes the key in OpenSSH format, encrypted if passphrase is not empty
+func writeOpenSSHKey(t *testing.T, key interface{}, passphrase string) string {
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "test")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "test", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal("Can't marshal key: ", err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "id_key")
+	if err = ioutil.WriteFile(fileName, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal("Can't write key: ", err)
+	}
+	return fileName
+}
+
+func TestLoadSSHPrivateKey(t *testing.T) {
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	plainFile := writeOpenSSHKey(t, ed25519Key, "")
+	encryptedFile := writeOpenSSHKey(t, ecdsaKey, "secret")
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	ioutil.WriteFile(passphraseFile, []byte("secret\n"), 0600)
+	t.Setenv("TEST_KEY_PASSPHRASE", "secret")
+
+	signer, err := loadSSHPrivateKey(plainFile, sshKeyPassphrase{})
+	if err != nil || signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("Can't load unencrypted ed25519 key: %v", err)
+	}
+
+	for name, source := range map[string]sshKeyPassphrase{
+		"config": {passphrase: "secret"},
+		"env":    {envVar: "TEST_KEY_PASSPHRASE"},
+		"file":   {file: passphraseFile},
+	} {
+		if _, err := loadSSHPrivateKey(encryptedFile, source); err != nil {
+			t.Fatalf("Can't load encrypted key with passphrase from %s: %s", name, err.Error())
+		}
+	}
+
+	_, err = loadSSHPrivateKey(encryptedFile, sshKeyPassphrase{passphrase: "wrong"})
+	if err == nil || !strings.Contains(err.Error(), "Wrong passphrase") {
+		t.Fatalf("Expected a wrong passphrase error, got: %v", err)
+	}
+
+	_, err = loadSSHPrivateKey(encryptedFile, sshKeyPassphrase{})
+	if err == nil || !strings.Contains(err.Error(), "no passphrase") {
+		t.Fatalf("Expected a missing passphrase error, got: %v", err)
+	}
+
+	// The legacy encrypted PEM keys are still supported
+	if _, err = loadSSHPrivateKey("testdata/server_id_rsa",
+		sshKeyPassphrase{passphrase: "TestTest"}); err != nil {
+		t.Fatalf("Can't load encrypted PEM key: %s", err.Error())
+	}
+}
+
+func TestDRServerWithMultipleHostKeys(t *testing.T) {
+	const serverAddress string = "localhost:7014"
+
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	clientsDB, err := ClientsDBFromToml("testdata/clients.toml")
+	if err != nil {
+		t.Fatal("Cant read the clients.toml file: ", err)
+	}
+
+	server, err := DRServerSSHNew(DRServerSSHConfig{
+		ClientsDB: clientsDB,
+		SSHServerKeyFileNames: []string{"testdata/server_id_rsa",
+			writeOpenSSHKey(t, ed25519Key, "TestTest")},
+		SSHServerKeyPassphrase: "TestTest",
+	})
+	if err != nil {
+		t.Fatal("Can't create server: ", err)
+	}
+	go server.ListenAndServe(serverAddress)
+	time.Sleep(100 * time.Millisecond)
+	defer server.Stop()
+
+	for _, algorithm := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA256} {
+		var serverKey ssh.PublicKey
+		config := ssh.ClientConfig{
+			HostKeyAlgorithms: []string{algorithm},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				serverKey = key
+				return fmt.Errorf("Key fetched")
+			},
+		}
+		ssh.Dial("tcp", serverAddress, &config)
+		if serverKey == nil {
+			t.Fatalf("Server has no %s key", algorithm)
+		}
+	}
+}
+
+// channelConnPair returns the two ends of an SSH channel over a local connection, the local
+// one as an sshChannelConn
+func channelConnPair(t *testing.T) (*sshChannelConn, ssh.Channel) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal("Can't create the host key: ", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Can't listen: ", err)
+	}
+	defer listener.Close()
+	remote := make(chan ssh.Channel, 1)
+	go func() {
+		serverSide, err := listener.Accept()
+		if err != nil {
+			close(remote)
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err != nil {
+			close(remote)
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		channel, requests, _ := (<-chans).Accept()
+		go ssh.DiscardRequests(requests)
+		remote <- channel
+	}()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Can't connect: ", err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(clientSide, "localhost", &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal("Can't connect over SSH: ", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "")
+		}
+	}()
+	t.Cleanup(func() { sshConn.Close() })
+
+	channel, requests, err := sshConn.OpenChannel("test", nil)
+	if err != nil {
+		t.Fatal("Can't open the channel: ", err)
+	}
+	go ssh.DiscardRequests(requests)
+	return sshChannelConnNew(channel, clientSide.LocalAddr(), clientSide.RemoteAddr(), nil),
+		<-remote
+}
+
+func TestSSHChannelConnDeadlines(t *testing.T) {
+	conn, remote := channelConnPair(t)
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Expected the read to time out, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("The read timed out late: %s", time.Since(start))
+	}
+
+	// Clearing the deadline makes the conn readable again
+	conn.SetReadDeadline(time.Time{})
+	go remote.Write([]byte("hello"))
+	buffer := make([]byte, 10)
+	n, err := conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "hello" {
+		t.Fatalf("Expected to read hello, got %q: %v", buffer[:n], err)
+	}
+
+	// A deadline set while a read is blocked unblocks it
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buffer)
+		readErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.SetDeadline(time.Now())
+	select {
+	case err = <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Expected the blocked read to time out, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The blocked read wasn't unblocked by the deadline")
+	}
+
+	// The remote end doesn't read, so the writes block once the channel window is full
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	data := make([]byte, 64*1024)
+	for i := 0; ; i++ {
+		if _, err = conn.Write(data); err != nil {
+			break
+		}
+		if i > 1000 {
+			t.Fatalf("The writes never blocked")
+		}
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected the write to time out, got: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package dryred
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackClientState is the state of a supervised back client
+type BackClientState int
+
+const (
+	BackClientConnecting BackClientState = iota
+	BackClientOnline
+	BackClientBackingOff
+	BackClientStopped
+)
+
+func (state BackClientState) String() string {
+	switch state {
+	case BackClientConnecting:
+		return "connecting"
+	case BackClientOnline:
+		return "online"
+	case BackClientBackingOff:
+		return "backing off"
+	case BackClientStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("BackClientState(%d)", int(state))
+}
+
+// DRSupervisor keeps a back client registered on the server, reconnecting with exponential
+// backoff every time the connection is lost. Set the client KeepAliveInterval to find out
+// quickly about the connections silently dropped by the network.
+type DRSupervisor interface {
+	// Run serves the forwarded sessions until stopped
+	Run() error
+	Stop() error
+}
+
+// DRSupervisorConfig describes the supervised back client
+type DRSupervisorConfig struct {
+	Client        DRClient
+	ServerAddress string
+	Handler       FWSessionHandler
+
+	// The wait before reconnecting starts at MinBackoff, by default 1s, and doubles after every
+	// failure up to MaxBackoff, by default 2m. A random jitter of up to half of it is removed,
+	// so a fleet of devices doesn't reconnect all at once.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RegisterTimeout bounds every attempt to connect and register, by default 30s
+	RegisterTimeout time.Duration
+
+	// StateChanged, if not nil, is called on every state change, with the error that caused it
+	StateChanged func(state BackClientState, err error)
+}
+
+type sshDRSupervisor struct {
+	config DRSupervisorConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+	state  BackClientState
+}
+
+func DRSupervisorNew(config DRSupervisorConfig) DRSupervisor {
+	if config.MinBackoff == 0 {
+		config.MinBackoff = time.Second
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 2 * time.Minute
+	}
+	if config.RegisterTimeout == 0 {
+		config.RegisterTimeout = 30 * time.Second
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = config.MinBackoff
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sshDRSupervisor{
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+		state:  BackClientStopped,
+	}
+}
+
+func (supervisor *sshDRSupervisor) setState(state BackClientState, err error) {
+	supervisor.lock.Lock()
+	changed := supervisor.state != state
+	supervisor.state = state
+	supervisor.lock.Unlock()
+
+	if changed && supervisor.config.StateChanged != nil {
+		supervisor.config.StateChanged(state, err)
+	}
+}
+
+// backoffWithJitter returns the wait before the next attempt, between half and all of backoff
+func backoffWithJitter(backoff time.Duration) time.Duration {
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func (supervisor *sshDRSupervisor) Run() error {
+	config := supervisor.config
+	backoff := config.MinBackoff
+
+	for {
+		supervisor.setState(BackClientConnecting, nil)
+
+		// A registration stuck on a dead network is given up after RegisterTimeout
+		ctx, cancel := context.WithCancel(supervisor.ctx)
+		timer := time.AfterFunc(config.RegisterTimeout, cancel)
+
+		var online time.Time
+		err := config.Client.ServeViaServerContext(ctx, config.ServerAddress,
+			config.Handler, func() {
+				timer.Stop()
+				online = time.Now()
+				supervisor.setState(BackClientOnline, nil)
+			})
+		timer.Stop()
+		cancel()
+
+		if supervisor.ctx.Err() != nil {
+			supervisor.setState(BackClientStopped, nil)
+			return nil
+		}
+
+		// A connection that stayed up for a while was a success, so start over
+		if !online.IsZero() && time.Since(online) > backoff {
+			backoff = config.MinBackoff
+		}
+
+		supervisor.setState(BackClientBackingOff, err)
+		select {
+		case <-time.After(backoffWithJitter(backoff)):
+		case <-supervisor.ctx.Done():
+			supervisor.setState(BackClientStopped, nil)
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+}
+
+func (supervisor *sshDRSupervisor) Stop() error {
+	supervisor.cancel()
+	return nil
+}
@@ -0,0 +1,145 @@
+package dryred
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blackholeProxy forwards the connections to the target until frozen. Then it keeps the
+// connections open, but drops all the data, like a dead NAT mapping.
+type blackholeProxy struct {
+	listener net.Listener
+	lock     sync.Mutex
+	frozen   bool
+}
+
+func startBlackholeProxy(t *testing.T, address, target string) *blackholeProxy {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", address, err.Error())
+	}
+	proxy := &blackholeProxy{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			targetConn, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go proxy.copy(targetConn, conn)
+			go proxy.copy(conn, targetConn)
+		}
+	}()
+	return proxy
+}
+
+func (proxy *blackholeProxy) copy(dst, src net.Conn) {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := src.Read(buffer)
+		if err != nil {
+			return
+		}
+		proxy.lock.Lock()
+		frozen := proxy.frozen
+		proxy.lock.Unlock()
+		if !frozen {
+			dst.Write(buffer[:n])
+		}
+	}
+}
+
+func (proxy *blackholeProxy) freeze() {
+	proxy.lock.Lock()
+	proxy.frozen = true
+	proxy.lock.Unlock()
+}
+
+func waitForState(t *testing.T, states <-chan BackClientState, expected BackClientState) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("The back client didn't get %s", expected)
+		}
+	}
+}
+
+func TestDRSupervisorReconnects(t *testing.T) {
+	const serverAddress string = "localhost:7020"
+	const proxyAddress string = "localhost:7021"
+	const targetAddress string = "localhost:7022"
+
+	defer startEchoServer(t, targetAddress).Close()
+	proxy := startBlackholeProxy(t, proxyAddress, serverAddress)
+	defer proxy.listener.Close()
+
+	backClient, err := DRClientSSHNew(DRClientSSHConfig{
+		SSHKeyFileName:    "testdata/back_id_rsa",
+		SSHKeyPassPhrase:  "TestTest",
+		User:              "pi",
+		KnownHostsFile:    filepath.Join(t.TempDir(), "known_hosts"),
+		KeepAliveInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Can't create back client: %s", err.Error())
+	}
+
+	states := make(chan BackClientState, 100)
+	supervisor := DRSupervisorNew(DRSupervisorConfig{
+		Client:        backClient,
+		ServerAddress: proxyAddress,
+		Handler:       FWDialHandlerNew([]string{targetAddress}),
+		MinBackoff:    50 * time.Millisecond,
+		MaxBackoff:    200 * time.Millisecond,
+		StateChanged: func(state BackClientState, err error) {
+			states <- state
+		},
+	})
+	stopped := make(chan error)
+	go func() {
+		stopped <- supervisor.Run()
+	}()
+
+	// The server is not started yet
+	waitForState(t, states, BackClientBackingOff)
+
+	server := startTestServer(t, serverAddress)
+	defer server.Stop()
+	waitForState(t, states, BackClientOnline)
+
+	frontClient := testClient(t, "testdata/front_id_rsa", "elisescu")
+	frontConn, err := frontClient.Connect(serverAddress, "pi", targetAddress)
+	if err != nil {
+		t.Fatalf("Can't connect to the supervised back client: %s", err.Error())
+	}
+	frontConn.Close()
+
+	// The keepalives find out about the connection silently dropped by the proxy
+	proxy.freeze()
+	start := time.Now()
+	waitForState(t, states, BackClientBackingOff)
+	if time.Since(start) > time.Second {
+		t.Fatalf("The dead connection was found only after %s", time.Since(start))
+	}
+
+	supervisor.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The supervisor didn't stop")
+	}
+	waitForState(t, states, BackClientStopped)
+}